@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/PawCorp/walltaker-desktop-client/walltaker"
+)
+
+// parsePostID reads an e621 post ID, either the number or a post page URL
+// like https://e621.net/posts/123
+func parsePostID(text string) (int, error) {
+	input := strings.TrimSpace(text)
+	if i := strings.Index(input, "/posts/"); i >= 0 {
+		input = input[i+len("/posts/"):]
+		if end := strings.IndexAny(input, "/?#"); end >= 0 {
+			input = input[:end]
+		}
+	}
+	id, err := strconv.Atoi(input)
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("%q is not an e621 post ID or URL", strings.TrimSpace(text))
+	}
+	return id, nil
+}
+
+// setLinkPost sets the wallpaper of link linkID, usually somebody else's,
+// to an e621 post
+func setLinkPost(linkID int64, postID int) error {
+	_, err := authedClient().SetPost(rootCtx, linkID, postID)
+	if err != nil {
+		return describeActionError(err)
+	}
+	log.Printf("Set link %d to post %d\n", linkID, postID)
+	return nil
+}
+
+// respondToPost tells whoever set our wallpaper what we think of it
+func respondToPost(response walltaker.Response) error {
+	_, err := authedClient().Respond(rootCtx, app.Feed(), response)
+	if err != nil {
+		return describeActionError(err)
+	}
+	log.Printf("Responded %s to link %d\n", response.Type, app.Feed())
+	return nil
+}
+
+// describeActionError turns the errors people can fix into advice
+func describeActionError(err error) error {
+	var statusErr *walltaker.StatusError
+	switch {
+	case errors.Is(err, walltaker.ErrNoAPIKey):
+		return errors.New("no API key set, add yours from your Walltaker dashboard with \"Set API Key\" or `walltaker apikey set`")
+	case errors.As(err, &statusErr) && (statusErr.StatusCode == 401 || statusErr.StatusCode == 403):
+		if statusErr.Message != "" {
+			return fmt.Errorf("walltaker refused your API key (%s: %s)", statusErr.Status, statusErr.Message)
+		}
+		return fmt.Errorf("walltaker refused your API key (%s)", statusErr.Status)
+	}
+	return err
+}
+
+// notifyActionResult shows how something the user asked for went
+func notifyActionResult(done string, err error) {
+	body := done
+	if err != nil {
+		log.Println("Action failed: ", err)
+		body = "Failed: " + err.Error()
+	}
+	sendNotification(Notification{
+		Event:  "action",
+		Title:  "Walltaker",
+		Body:   body,
+		LinkID: int(app.Feed()),
+	})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/PawCorp/walltaker-desktop-client/walltaker"
+	"github.com/zalando/go-keyring"
+)
+
+// keyringService and keyringUser are where the API key lives in the OS
+// keyring (Windows Credential Manager, macOS Keychain, Secret Service)
+const keyringService = "walltaker"
+const keyringUser = "api-key"
+
+// apiKey is the key actions are sent with. It can change from the tray while
+// an action is running, so it's kept here rather than on walltakerClient.
+var apiKey string
+var apiKeyMu sync.Mutex
+
+func setAPIKey(key string) {
+	apiKeyMu.Lock()
+	defer apiKeyMu.Unlock()
+	apiKey = key
+}
+
+// authedClient is walltakerClient with the current API key
+func authedClient() *walltaker.Client {
+	apiKeyMu.Lock()
+	defer apiKeyMu.Unlock()
+	client := *walltakerClient
+	client.APIKey = apiKey
+	return &client
+}
+
+// apiKeyFile is where the API key goes when there's no keyring, e.g. on
+// Linux without a Secret Service. Only the user can read it.
+func apiKeyFile() (string, error) {
+	dir, err := walltakerDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "api-key"), nil
+}
+
+// loadAPIKey finds the API key: apiKey in walltaker.toml if set, else the
+// keyring, else the file fallback. It's empty if there's none anywhere.
+func loadAPIKey(fromConfig string) string {
+	if key := strings.TrimSpace(fromConfig); key != "" {
+		return key
+	}
+	key, err := keyring.Get(keyringService, keyringUser)
+	if err == nil {
+		return key
+	}
+	if !errors.Is(err, keyring.ErrNotFound) {
+		log.Println("Could not read API key from keyring: ", err)
+	}
+	file, err := apiKeyFile()
+	if err != nil {
+		return ""
+	}
+	dat, err := os.ReadFile(file)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(dat))
+}
+
+// storeAPIKey keeps key in the keyring, or in the fallback file if there's
+// no keyring. It returns where the key went.
+func storeAPIKey(key string) (string, error) {
+	err := keyring.Set(keyringService, keyringUser, key)
+	if err == nil {
+		// don't leave an old key behind to confuse loadAPIKey
+		if file, fileErr := apiKeyFile(); fileErr == nil {
+			os.Remove(file)
+		}
+		return "the system keyring", nil
+	}
+	log.Println("Could not store API key in keyring, using a file instead: ", err)
+
+	file, err := apiKeyFile()
+	if err != nil {
+		return "", err
+	}
+	err = writeFileAtomic(file, []byte(key+"\n"))
+	if err != nil {
+		return "", err
+	}
+	return file, nil
+}
+
+// clearAPIKey removes the API key from the keyring and the fallback file
+func clearAPIKey() error {
+	err := keyring.Delete(keyringService, keyringUser)
+	if err != nil && !errors.Is(err, keyring.ErrNotFound) {
+		log.Println("Could not remove API key from keyring: ", err)
+	}
+	file, err := apiKeyFile()
+	if err != nil {
+		return err
+	}
+	err = os.Remove(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"log"
+
+	"walltaker/flow"
+)
+
+// app is the state shared by the cable handler, the wallpaper queue, the
+// tray and the dashboard
+var app = flow.NewApp(flow.Settings{Crop: true})
+
+// logAppEvent writes changes to the log
+func logAppEvent(event flow.AppEvent) {
+	switch event.Kind {
+	case flow.EventPost:
+		log.Println("Current post is now ", event.Post.PostURL.String)
+	case flow.EventFeed:
+		log.Println("Watching link ", event.Feed)
+	case flow.EventConnection:
+		log.Println("Connected to Walltaker: ", event.Connected)
+	case flow.EventOffline:
+		log.Println("Offline: ", event.Offline)
+	case flow.EventSettings:
+		now, was := event.Settings, event.Previous
+		logSettingChange("crop", now.Crop, was.Crop)
+		logSettingChange("saveLocally", now.SaveLocally, was.SaveLocally)
+		logSettingChange("discordPresence", now.DiscordPresence, was.DiscordPresence)
+		logSettingChange("notifications", now.Notifications, was.Notifications)
+		logSettingChange("safeMode", now.SafeMode, was.SafeMode)
+	}
+}
+
+func logSettingChange(name string, now bool, was bool) {
+	if now != was {
+		log.Printf("Changed %s to %t\n", name, now)
+	}
+}
@@ -0,0 +1,108 @@
+// Package backend is what actually changes the desktop wallpaper. The client
+// only talks to a Backend, so it can be run against a Recorder instead of
+// the real desktop.
+package backend
+
+import (
+	"sync"
+
+	"github.com/reujab/wallpaper"
+)
+
+// Mode is how an image is fitted to the screen
+type Mode int
+
+const (
+	Crop Mode = iota
+	Fit
+)
+
+func (m Mode) String() string {
+	if m == Fit {
+		return "fit"
+	}
+	return "crop"
+}
+
+// Backend gets and sets the desktop wallpaper
+type Backend interface {
+	// Get returns the file of the current wallpaper
+	Get() (string, error)
+	SetFromFile(file string) error
+	SetMode(mode Mode) error
+}
+
+// System is the desktop wallpaper of this computer
+type System struct{}
+
+func (System) Get() (string, error) {
+	return wallpaper.Get()
+}
+
+func (System) SetFromFile(file string) error {
+	return wallpaper.SetFromFile(file)
+}
+
+func (System) SetMode(mode Mode) error {
+	if mode == Fit {
+		return wallpaper.SetMode(wallpaper.Fit)
+	}
+	return wallpaper.SetMode(wallpaper.Crop)
+}
+
+// Recorder is a pretend desktop that remembers what it was asked to do
+type Recorder struct {
+	mu    sync.Mutex
+	file  string
+	mode  Mode
+	files []string
+	// Changed gets every file set, if not nil. Sends don't block, so give
+	// it a buffer.
+	Changed chan string
+}
+
+// NewRecorder starts with original as the wallpaper
+func NewRecorder(original string) *Recorder {
+	return &Recorder{file: original}
+}
+
+func (r *Recorder) Get() (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.file, nil
+}
+
+func (r *Recorder) SetFromFile(file string) error {
+	r.mu.Lock()
+	r.file = file
+	r.files = append(r.files, file)
+	r.mu.Unlock()
+	if r.Changed != nil {
+		select {
+		case r.Changed <- file:
+		default:
+		}
+	}
+	return nil
+}
+
+func (r *Recorder) SetMode(mode Mode) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.mode = mode
+	return nil
+}
+
+// Files lists every file set, oldest first
+func (r *Recorder) Files() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string{}, r.files...)
+}
+
+// Mode is the last mode set
+func (r *Recorder) Mode() Mode {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.mode
+}
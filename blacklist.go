@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"walltaker/e621"
+	"walltaker/flow"
+
+	"github.com/PawCorp/walltaker-desktop-client/walltaker"
+	"github.com/getlantern/systray"
+)
+
+// linkInfoLength is how much of the terms and blacklist fit in the tray
+const linkInfoLength = 60
+
+// addLinkInfoMenu adds the Terms & Blacklist submenu, refreshed with every
+// update of the link. Clicking either opens the link page with all of it.
+func addLinkInfoMenu() {
+	menuInfo := systray.AddMenuItem("Terms & Blacklist", "Your link's terms and blacklist, as Walltaker has them")
+	menuTerms := menuInfo.AddSubMenuItem("Terms: -", "")
+	menuBlacklist := menuInfo.AddSubMenuItem("Blacklist: -", "")
+
+	show := func(link walltaker.Link) {
+		menuTerms.SetTitle("Terms: " + shortenForMenu(link.Terms))
+		menuTerms.SetTooltip(link.Terms)
+		menuBlacklist.SetTitle("Blacklist: " + shortenForMenu(link.Blacklist))
+		menuBlacklist.SetTooltip(link.Blacklist)
+	}
+	show(app.Link())
+	app.Subscribe(func(event flow.AppEvent) {
+		if event.Kind == flow.EventLink {
+			show(event.Link)
+		}
+	})
+
+	go func() {
+		for {
+			select {
+			case <-rootCtx.Done():
+				return
+			case <-menuTerms.ClickedCh:
+				openMyWtWebAppLink(app.Feed())
+			case <-menuBlacklist.ClickedCh:
+				openMyWtWebAppLink(app.Feed())
+			}
+		}
+	}()
+}
+
+// shortenForMenu fits text on one menu line
+func shortenForMenu(text string) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if text == "" {
+		return "-"
+	}
+	runes := []rune(text)
+	if len(runes) > linkInfoLength {
+		return string(runes[:linkInfoLength-1]) + "…"
+	}
+	return text
+}
+
+// checkBlacklist warns if a post has tags its link's blacklist bans.
+// Walltaker should never let that happen, so it's a bug or somebody
+// getting around it.
+func checkBlacklist(userData walltaker.Link) {
+	if strings.TrimSpace(userData.Blacklist) == "" || userData.PostURL.String == "" {
+		return
+	}
+	post := lookupPost(userData.PostURL.String)
+	if post == nil {
+		return
+	}
+	hits := blacklistHits(userData.Blacklist, post)
+	if len(hits) == 0 {
+		return
+	}
+
+	setter := userData.SetBy.String
+	if setter == "" {
+		setter = "Anonymous"
+	}
+	log.Println("Post ", userData.PostURL.String, " set by ", setter, " has blacklisted tags: ", hits)
+	sendNotification(Notification{
+		Event:   "blacklist",
+		Title:   "Walltaker",
+		Body:    fmt.Sprintf("%s set a post with blacklisted tags (%s). Walltaker should have stopped that, please report it.", setter, strings.Join(hits, ", ")),
+		PostURL: userData.PostURL.String,
+		SetBy:   userData.SetBy.String,
+		LinkID:  userData.ID,
+	})
+}
+
+// blacklistHits returns the lines of an e621 style blacklist that post
+// matches. Like on e621, every tag on a line must match, none of those
+// starting with "-" may, and one of those starting with "~" must.
+// "rating:e" and the like match the rating. Lines with other metatags, or
+// only negated tags, are skipped.
+func blacklistHits(blacklist string, post *e621.Post) []string {
+	hits := []string{}
+	tags := postTags(post)
+	for _, line := range strings.Split(strings.ToLower(blacklist), "\n") {
+		entries := strings.Fields(line)
+		if blacklistLineMatches(entries, post.Rating, tags) {
+			hits = append(hits, strings.Join(entries, " "))
+		}
+	}
+	return hits
+}
+
+func blacklistLineMatches(entries []string, rating string, tags []string) bool {
+	banning := false
+	anyOf, anyMatched := false, false
+	for _, entry := range entries {
+		tag := strings.TrimLeft(entry, "-~")
+		if tag == "" {
+			continue
+		}
+		matches, ok := postHasTag(tag, rating, tags)
+		if !ok {
+			return false
+		}
+		switch entry[0] {
+		case '-':
+			if matches {
+				return false
+			}
+		case '~':
+			anyOf = true
+			anyMatched = anyMatched || matches
+		default:
+			if !matches {
+				return false
+			}
+			banning = true
+		}
+	}
+	if anyOf && !anyMatched {
+		return false
+	}
+	return banning || anyOf
+}
+
+// postHasTag reports whether a post with rating and tags has tag. ok is
+// false for metatags we can't check.
+func postHasTag(tag string, rating string, tags []string) (matches bool, ok bool) {
+	if want := strings.TrimPrefix(tag, "rating:"); want != tag {
+		return want != "" && rating != "" && want[0] == strings.ToLower(rating)[0], true
+	}
+	if strings.Contains(tag, ":") {
+		return false, false
+	}
+	return containsFold(tags, tag), true
+}
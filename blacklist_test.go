@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"walltaker/e621"
+)
+
+func TestBlacklistHits(t *testing.T) {
+	post := &e621.Post{Rating: "e"}
+	post.Tags.General = []string{"animated", "solo"}
+	post.Tags.Species = []string{"canine"}
+
+	for _, test := range []struct {
+		blacklist string
+		want      []string
+	}{
+		{"animated", []string{"animated"}},
+		{"feral animated", []string{}},
+		{"canine animated", []string{"canine animated"}},
+		{"feral\nanimated", []string{"animated"}},
+		{"animated -solo", []string{}},
+		{"animated -feral", []string{"animated -feral"}},
+		{"-feral", []string{}},
+		{"~feral ~canine", []string{"~feral ~canine"}},
+		{"~feral ~scalie", []string{}},
+		{"rating:e animated", []string{"rating:e animated"}},
+		{"rating:s animated", []string{}},
+		{"Rating:Explicit", []string{"rating:explicit"}},
+		{"animated score:<0", []string{}},
+		{"  gore \r\n\n  Canine  Solo ", []string{"canine solo"}},
+		{"", []string{}},
+	} {
+		got := blacklistHits(test.blacklist, post)
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%q: got %q, want %q", test.blacklist, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"walltaker/config"
+
+	"github.com/PawCorp/walltaker-desktop-client/walltaker"
+)
+
+// runCommand runs a command line command instead of the tray app. It returns
+// false when args don't start with a known command.
+func runCommand(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	switch args[0] {
+	case "revert":
+		revertCommand()
+	case "gallery":
+		galleryCommand(args[1:])
+	case "apikey":
+		apiKeyCommand(args[1:])
+	case "set":
+		setCommand(args[1:])
+	case "respond":
+		respondCommand(args[1:])
+	default:
+		return false
+	}
+	return true
+}
+
+// revertCommand restores the original wallpaper left behind by a run that
+// crashed or was killed, without starting the tray. A running tray app
+// restores it on exit, and would set its next post over it anyway.
+func revertCommand() {
+	lock := instanceLock()
+	if lock.TryLock() != nil {
+		fmt.Println("Walltaker is running, quit it to revert to your original wallpaper")
+		os.Exit(1)
+	}
+	defer lock.Unlock()
+
+	if originalWallpaperFile() == "" {
+		fmt.Println("No original wallpaper to revert to")
+		return
+	}
+	fmt.Println("Reverting wallpaper to", originalWallpaperFile())
+	wallpapers.RestoreOriginal()
+	forgetOriginalWallpaper()
+}
+
+// loadCommandConfig sets up the API clients for a command, or exits if the
+// config can't be read
+func loadCommandConfig() config.Config {
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Println("Could not read walltaker.toml:", err)
+		os.Exit(1)
+	}
+	configureClients(cfg)
+	return cfg
+}
+
+func apiKeyCommand(args []string) {
+	usage := `Usage:
+  walltaker apikey set [key]
+  walltaker apikey clear`
+	if len(args) == 0 {
+		fmt.Println(usage)
+		os.Exit(2)
+	}
+	switch args[0] {
+	case "set":
+		key := ""
+		if len(args) > 1 {
+			key = args[1]
+		} else {
+			fmt.Print("API key: ")
+			fmt.Scanln(&key)
+		}
+		key = strings.TrimSpace(key)
+		if key == "" {
+			fmt.Println("No API key given")
+			os.Exit(2)
+		}
+		where, err := storeAPIKey(key)
+		if err != nil {
+			fmt.Println("Could not store API key:", err)
+			os.Exit(1)
+		}
+		fmt.Println("Stored API key in", where)
+	case "clear":
+		err := clearAPIKey()
+		if err != nil {
+			fmt.Println("Could not remove API key:", err)
+			os.Exit(1)
+		}
+		fmt.Println("Removed API key")
+	default:
+		fmt.Println(usage)
+		os.Exit(2)
+	}
+}
+
+// setCommand sets the wallpaper of a link to an e621 post
+func setCommand(args []string) {
+	if len(args) != 2 {
+		fmt.Println("Usage:\n  walltaker set <link id> <e621 post id or URL>")
+		os.Exit(2)
+	}
+	linkID, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		fmt.Println("Not a link ID:", args[0])
+		os.Exit(2)
+	}
+	postID, err := parsePostID(args[1])
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	loadCommandConfig()
+	err = setLinkPost(linkID, postID)
+	if err != nil {
+		fmt.Println("Could not set wallpaper:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Set link %d to post %d\n", linkID, postID)
+}
+
+// respondCommand responds to the current wallpaper of your link
+func respondCommand(args []string) {
+	types := strings.Join(walltaker.ResponseTypes, "|")
+	if len(args) == 0 || !containsFold(walltaker.ResponseTypes, args[0]) {
+		fmt.Println("Usage:\n  walltaker respond <" + types + "> [comment]")
+		os.Exit(2)
+	}
+	response := walltaker.Response{
+		Type: strings.ToLower(args[0]),
+		Text: strings.Join(args[1:], " "),
+	}
+	cfg := loadCommandConfig()
+	app.SetFeed(cfg.Feed)
+	err := respondToPost(response)
+	if err != nil {
+		fmt.Println("Could not respond:", err)
+		os.Exit(1)
+	}
+	fmt.Println("Responded", response.Type, "to link", cfg.Feed)
+}
+
+func galleryUsage() {
+	fmt.Println(`Usage:
+  walltaker gallery list [-setter name] [-tag tag] [-artist name] [-link id] [-since YYYY-MM-DD] [-until YYYY-MM-DD]
+  walltaker gallery apply <id>
+  walltaker gallery import [-link id] [folder]`)
+}
+
+func galleryCommand(args []string) {
+	if len(args) == 0 {
+		galleryUsage()
+		os.Exit(2)
+	}
+	switch args[0] {
+	case "list":
+		galleryListCommand(args[1:])
+	case "apply":
+		galleryApplyCommand(args[1:])
+	case "import":
+		galleryImportCommand(args[1:])
+	default:
+		galleryUsage()
+		os.Exit(2)
+	}
+}
+
+func galleryListCommand(args []string) {
+	flags := flag.NewFlagSet("gallery list", flag.ExitOnError)
+	setter := flags.String("setter", "", "only wallpapers set by this user")
+	tag := flags.String("tag", "", "only wallpapers with this e621 tag")
+	artist := flags.String("artist", "", "only wallpapers by this artist")
+	link := flags.Int("link", 0, "only wallpapers sent to this link ID")
+	since := flags.String("since", "", "only wallpapers saved on or after this date (YYYY-MM-DD)")
+	until := flags.String("until", "", "only wallpapers saved before this date (YYYY-MM-DD)")
+	flags.Parse(args)
+
+	query := GalleryQuery{
+		SetBy:  *setter,
+		Tag:    *tag,
+		Artist: *artist,
+		LinkID: *link,
+	}
+	var err error
+	if *since != "" {
+		query.Since, err = time.ParseInLocation("2006-01-02", *since, time.Local)
+		if err != nil {
+			fmt.Println("Invalid -since date:", err)
+			os.Exit(2)
+		}
+	}
+	if *until != "" {
+		query.Until, err = time.ParseInLocation("2006-01-02", *until, time.Local)
+		if err != nil {
+			fmt.Println("Invalid -until date:", err)
+			os.Exit(2)
+		}
+	}
+
+	gallery, err := loadGallery()
+	if err != nil {
+		fmt.Println("Could not read gallery:", err)
+		os.Exit(1)
+	}
+	results := gallery.search(query)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSAVED\tSET BY\tLINK\tPOST\tARTIST\tFILE")
+	for _, entry := range results {
+		post := "-"
+		if entry.PostID != 0 {
+			post = strconv.Itoa(entry.PostID)
+		}
+		setBy := entry.SetBy
+		if setBy == "" {
+			setBy = "anonymous"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%s\t%s\t%s\n", entry.ID, entry.SavedAt.Format("2006-01-02 15:04"), setBy, entry.LinkID, post, strings.Join(entry.Artists, "+"), entry.File)
+	}
+	w.Flush()
+	fmt.Printf("%d wallpapers\n", len(results))
+}
+
+// galleryApplyCommand sets a saved wallpaper, no network needed
+func galleryApplyCommand(args []string) {
+	if len(args) != 1 {
+		galleryUsage()
+		os.Exit(2)
+	}
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		fmt.Println("Not a gallery ID:", args[0])
+		os.Exit(2)
+	}
+
+	gallery, err := loadGallery()
+	if err != nil {
+		fmt.Println("Could not read gallery:", err)
+		os.Exit(1)
+	}
+	entry, ok := gallery.find(id)
+	if !ok {
+		fmt.Println("No wallpaper with ID", id)
+		os.Exit(1)
+	}
+	err = wallpapers.Backend.SetFromFile(entry.File)
+	if err != nil {
+		fmt.Println("Could not set wallpaper:", err)
+		os.Exit(1)
+	}
+	fmt.Println("Set wallpaper to", entry.File)
+}
@@ -0,0 +1,270 @@
+// Package config reads walltaker.toml
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml"
+)
+
+// FileName is the config file, kept next to the executable
+const FileName = "walltaker.toml"
+
+const DefaultBase = "https://walltaker.joi.how/links/"
+const DefaultE621 = "https://e621.net"
+const DefaultE926 = "https://e926.net"
+const DefaultSaveFilename = "walltaker_{setter}_{date}_{md5}.{ext}"
+const DefaultNotificationTitle = "Walltaker"
+const DefaultNotificationBody = "{setter} changed your wallpaper~"
+const DefaultPresenceState = "Set my wallpaper~"
+const DefaultPresenceDetails = "https://wt.pawcorp.org/{link}"
+const DefaultPresenceLargeImage = "eggplant"
+const DefaultPresenceLargeText = "Powered by joi.how"
+const DefaultPresenceButton = "Set my wallpaper"
+const DefaultDashboardPort = 8621
+
+var DefaultScreenShareProcesses = []string{
+	"zoom",
+	"obs",
+	"teams",
+	"teams-for-linux",
+	"skypeforlinux",
+	"webex",
+	"simplescreenrec",
+	"kazam",
+	"vokoscreenNG",
+	"peek",
+}
+
+// Config is everything in walltaker.toml
+type Config struct {
+	// Base is where links are fetched from, e.g. "https://walltaker.joi.how/links/"
+	Base string
+	// E621 is where posts are looked up, and E926 where e926 posts are
+	E621 string
+	E926 string
+	Feed int64
+	// APIKey is usually empty, the key is kept in the keyring instead
+	APIKey string
+	// E621Account is who we are to e621
+	E621Account E621Account
+	// Mode is "crop" or "fit"
+	Mode            string
+	SaveLocally     bool
+	SaveDirectory   string
+	SaveFilename    string
+	DedupSimilar    bool
+	DiscordPresence bool
+	Notifications   bool
+
+	NotificationTitle     string
+	NotificationBody      string
+	NotificationThumbnail bool
+
+	Presence Presence
+
+	DashboardEnabled bool
+	DashboardPort    int64
+
+	ScreenShareDetection bool
+	ScreenShareProcesses []string
+
+	Expiry Expiry
+
+	// Tree is the whole file, for sections read elsewhere like [Notify.*]
+	Tree *toml.Tree
+}
+
+// Presence is the [Presence] section
+type Presence struct {
+	State      string
+	Details    string
+	LargeImage string
+	LargeText  string
+	Button     string
+}
+
+// E621Account is the [E621] section
+type E621Account struct {
+	// Contact goes in the user agent, as e621 asks, so they can reach
+	// whoever is making the requests. It defaults to Username.
+	Contact string
+	// Username and APIKey log in, to look up posts hidden from guests
+	Username string
+	APIKey   string
+}
+
+// Expiry is the [Expiry] section: what to do as the link runs out
+type Expiry struct {
+	// Warnings are how long before expiry to notify, longest first
+	Warnings []time.Duration
+	// OnExpire is ExpireKeep, ExpireRestore or ExpireFallback
+	OnExpire string
+	// FallbackLink is the link to switch to with ExpireFallback
+	FallbackLink int64
+}
+
+const (
+	ExpireKeep     = "keep"
+	ExpireRestore  = "restore"
+	ExpireFallback = "fallback"
+)
+
+var DefaultExpiryWarnings = []string{"1h", "10m"}
+
+// Crop says if images should fill the whole screen; anything but "fit" crops
+func (c Config) Crop() bool {
+	return strings.ToLower(c.Mode) != "fit"
+}
+
+// WalltakerURL is the Walltaker site Base points into
+func (c Config) WalltakerURL() string {
+	return strings.TrimSuffix(strings.TrimRight(c.Base, "/"), "/links")
+}
+
+// Load reads the config file in dir
+func Load(dir string) (Config, error) {
+	dat, err := os.ReadFile(filepath.Join(dir, FileName))
+	if err != nil {
+		return Config{}, err
+	}
+	return Parse(string(dat))
+}
+
+// Parse reads a config. Base, Feed and the original [Preferences] must be
+// there, everything added since has a default.
+func Parse(dat string) (Config, error) {
+	tree, err := toml.Load(dat)
+	if err != nil {
+		return Config{}, err
+	}
+
+	c := Config{Tree: tree}
+	var errs []string
+	required := func(key string, value interface{}, ok bool) {
+		if value == nil {
+			errs = append(errs, key+" is missing")
+		} else if !ok {
+			errs = append(errs, fmt.Sprintf("%s has the wrong type (%T)", key, value))
+		}
+	}
+	var ok bool
+	value := tree.Get("Base.base")
+	c.Base, ok = value.(string)
+	required("Base.base", value, ok)
+	value = tree.Get("Feed.feed")
+	c.Feed, ok = value.(int64)
+	required("Feed.feed", value, ok)
+	value = tree.Get("Preferences.mode")
+	c.Mode, ok = value.(string)
+	required("Preferences.mode", value, ok)
+	value = tree.Get("Preferences.saveLocally")
+	c.SaveLocally, ok = value.(bool)
+	required("Preferences.saveLocally", value, ok)
+	value = tree.Get("Preferences.discordPresence")
+	c.DiscordPresence, ok = value.(bool)
+	required("Preferences.discordPresence", value, ok)
+	value = tree.Get("Preferences.notifications")
+	c.Notifications, ok = value.(bool)
+	required("Preferences.notifications", value, ok)
+	if len(errs) > 0 {
+		return c, fmt.Errorf("%s: %s", FileName, strings.Join(errs, ", "))
+	}
+
+	c.E621 = getString(tree, "Base.e621", DefaultE621)
+	c.E926 = getString(tree, "Base.e926", DefaultE926)
+	c.APIKey = getString(tree, "Auth.apiKey", "")
+	c.E621Account = E621Account{
+		Username: strings.TrimSpace(getString(tree, "E621.username", "")),
+		APIKey:   strings.TrimSpace(getString(tree, "E621.apiKey", "")),
+	}
+	c.E621Account.Contact = strings.TrimSpace(getString(tree, "E621.contact", ""))
+	if c.E621Account.Contact == "" {
+		c.E621Account.Contact = c.E621Account.Username
+	}
+	c.SaveDirectory = getString(tree, "Preferences.saveDirectory", "")
+	c.SaveFilename = getString(tree, "Preferences.saveFilename", DefaultSaveFilename)
+	if strings.TrimSpace(c.SaveFilename) == "" {
+		c.SaveFilename = DefaultSaveFilename
+	}
+	c.DedupSimilar = getBool(tree, "Preferences.dedupSimilar", false)
+	c.NotificationTitle = getString(tree, "Notifications.title", DefaultNotificationTitle)
+	c.NotificationBody = getString(tree, "Notifications.body", DefaultNotificationBody)
+	c.NotificationThumbnail = getBool(tree, "Notifications.thumbnail", true)
+	c.Presence = Presence{
+		State:      getString(tree, "Presence.state", DefaultPresenceState),
+		Details:    getString(tree, "Presence.details", DefaultPresenceDetails),
+		LargeImage: getString(tree, "Presence.largeImage", DefaultPresenceLargeImage),
+		LargeText:  getString(tree, "Presence.largeText", DefaultPresenceLargeText),
+		Button:     getString(tree, "Presence.button", DefaultPresenceButton),
+	}
+	c.DashboardEnabled = getBool(tree, "Dashboard.enabled", false)
+	c.DashboardPort, ok = tree.GetDefault("Dashboard.port", int64(DefaultDashboardPort)).(int64)
+	if !ok {
+		c.DashboardPort = DefaultDashboardPort
+	}
+	c.Expiry, err = parseExpiry(tree)
+	if err != nil {
+		return c, fmt.Errorf("%s: %w", FileName, err)
+	}
+	c.ScreenShareDetection = getBool(tree, "SafeMode.screenShareDetection", false)
+	c.ScreenShareProcesses = DefaultScreenShareProcesses
+	if processes, ok := tree.GetArray("SafeMode.screenShareProcesses").([]string); ok {
+		c.ScreenShareProcesses = processes
+	}
+	return c, nil
+}
+
+func parseExpiry(tree *toml.Tree) (Expiry, error) {
+	expiry := Expiry{
+		OnExpire: strings.ToLower(getString(tree, "Expiry.onExpire", ExpireKeep)),
+	}
+	warnings := DefaultExpiryWarnings
+	if values, ok := tree.GetArray("Expiry.warnings").([]string); ok {
+		warnings = values
+	}
+	for _, warning := range warnings {
+		d, err := time.ParseDuration(warning)
+		if err != nil || d <= 0 {
+			return expiry, fmt.Errorf("Expiry.warnings: %q is not a duration like \"1h\" or \"10m\"", warning)
+		}
+		expiry.Warnings = append(expiry.Warnings, d)
+	}
+	sort.Slice(expiry.Warnings, func(i, j int) bool {
+		return expiry.Warnings[i] > expiry.Warnings[j]
+	})
+
+	switch expiry.OnExpire {
+	case ExpireKeep, ExpireRestore:
+	case ExpireFallback:
+		link, ok := tree.GetDefault("Expiry.fallbackLink", int64(0)).(int64)
+		if !ok || link <= 0 {
+			return expiry, fmt.Errorf("Expiry.fallbackLink must be a link ID when onExpire is %q", ExpireFallback)
+		}
+		expiry.FallbackLink = link
+	default:
+		return expiry, fmt.Errorf("Expiry.onExpire must be %q, %q or %q", ExpireKeep, ExpireRestore, ExpireFallback)
+	}
+	return expiry, nil
+}
+
+func getString(tree *toml.Tree, key string, def string) string {
+	value, ok := tree.GetDefault(key, def).(string)
+	if !ok {
+		return def
+	}
+	return value
+}
+
+func getBool(tree *toml.Tree, key string, def bool) bool {
+	value, ok := tree.GetDefault(key, def).(bool)
+	if !ok {
+		return def
+	}
+	return value
+}
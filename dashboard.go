@@ -0,0 +1,344 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"walltaker/e621"
+	"walltaker/flow"
+
+	"github.com/PawCorp/walltaker-desktop-client/walltaker"
+	"github.com/pkg/browser"
+)
+
+// maxHistory is how many wallpapers of this session the dashboard remembers
+const maxHistory = 100
+
+//go:embed dashboard
+var dashboardAssets embed.FS
+
+// settingRequest asks the tray menu loop to change a setting, so the
+// dashboard and the tray checkboxes never disagree
+type settingRequest struct {
+	Setting string `json:"setting"`
+	Enabled bool   `json:"enabled"`
+	LinkID  int64  `json:"link_id"`
+}
+
+var settingRequests = make(chan settingRequest)
+
+type HistoryEntry struct {
+	LinkID       int       `json:"link_id"`
+	PostURL      string    `json:"post_url"`
+	ThumbnailURL string    `json:"thumbnail_url"`
+	SetBy        string    `json:"set_by"`
+	At           time.Time `json:"at"`
+}
+
+var history []HistoryEntry
+var historyMu sync.Mutex
+
+var dashboardPostCache = map[string]dashboardPost{}
+var dashboardPostCacheMu sync.Mutex
+
+// dashboardPost is what the dashboard shows about a post from its source
+type dashboardPost struct {
+	Source  string     `json:"source"`
+	PageURL string     `json:"page_url"`
+	Post    *e621.Post `json:"post"`
+}
+
+var sessionStart = time.Now()
+
+func addToHistory(userData walltaker.Link) {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+
+	history = append([]HistoryEntry{{
+		LinkID:       userData.ID,
+		PostURL:      userData.PostURL.String,
+		ThumbnailURL: thumbnailURL(userData),
+		SetBy:        userData.SetBy.String,
+		At:           time.Now(),
+	}}, history...)
+	if len(history) > maxHistory {
+		history = history[:maxHistory]
+	}
+}
+
+// thumbnailURL returns Walltaker's thumbnail for the post, or the post itself
+// if there is none
+func thumbnailURL(userData walltaker.Link) string {
+	if thumbnail := userData.PostThumbnailURL.String; thumbnail != "" {
+		return thumbnail
+	}
+	return userData.PostURL.String
+}
+
+// dashboardSourcePost looks up the post for a wallpaper at its source once
+// and remembers it, the dashboard polls far too often to ask every time
+func dashboardSourcePost(postUrl string) dashboardPost {
+	dashboardPostCacheMu.Lock()
+	info, ok := dashboardPostCache[postUrl]
+	dashboardPostCacheMu.Unlock()
+	if ok {
+		return info
+	}
+
+	source := sourceFor(postUrl)
+	post, err := source.Lookup(postUrl)
+	if err != nil {
+		log.Println("Dashboard could not look up post on ", source.Name(), ": ", err)
+		// try again next time
+		return dashboardPost{Source: source.Name(), PageURL: postUrl}
+	}
+	info = dashboardPost{
+		Source:  source.Name(),
+		PageURL: source.PageURL(postUrl),
+		Post:    post,
+	}
+	dashboardPostCacheMu.Lock()
+	dashboardPostCache[postUrl] = info
+	dashboardPostCacheMu.Unlock()
+	return info
+}
+
+func dashboardURL(port int64) string {
+	return fmt.Sprintf("http://localhost:%d/", port)
+}
+
+func openDashboard(port int64) {
+	browser.OpenURL(dashboardURL(port))
+}
+
+// serveDashboard serves the web dashboard on localhost only
+func serveDashboard(port int64) {
+	assets, err := fs.Sub(dashboardAssets, "dashboard")
+	if err != nil {
+		log.Println("Could not load dashboard: ", err)
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", http.FileServer(http.FS(assets)))
+	mux.HandleFunc("/api/status", dashboardStatus)
+	mux.HandleFunc("/api/history", dashboardHistory)
+	mux.HandleFunc("/api/gallery", dashboardGallery)
+	mux.HandleFunc("/api/gallery/image", dashboardGalleryImage)
+	mux.HandleFunc("/api/gallery/apply", dashboardGalleryApply)
+	mux.HandleFunc("/api/settings", dashboardSettings)
+	mux.HandleFunc("/api/safe-mode/toggle", dashboardToggleSafeMode)
+
+	addr := net.JoinHostPort("127.0.0.1", strconv.FormatInt(port, 10))
+	log.Println("Serving dashboard on ", dashboardURL(port))
+	err = http.ListenAndServe(addr, localOnly(mux))
+	if err != nil {
+		log.Println("Dashboard stopped: ", err)
+	}
+}
+
+// localOnly turns away requests that don't come from a page on the dashboard
+// itself: other hostnames (DNS rebinding) and cross-site form posts
+func localOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if host != "localhost" && host != "127.0.0.1" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			origin := r.Header.Get("Origin")
+			if origin != "" && origin != "http://"+r.Host {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+				http.Error(w, "expected JSON", http.StatusUnsupportedMediaType)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Println("Dashboard could not write response: ", err)
+	}
+}
+
+func dashboardStatus(w http.ResponseWriter, r *http.Request) {
+	current := app.CurrentPost()
+	var currentPost interface{}
+	if current.PostURL.String != "" {
+		setBy := current.SetBy.String
+		if setBy == "" {
+			setBy = "Anonymous"
+		}
+		currentPost = map[string]interface{}{
+			"link_id":       current.ID,
+			"post_url":      current.PostURL.String,
+			"thumbnail_url": thumbnailURL(current),
+			"set_by":        setBy,
+			"updated_at":    current.UpdatedAt,
+			"source":        dashboardSourcePost(current.PostURL.String),
+		}
+	}
+
+	stateMu.Lock()
+	stats := map[string]interface{}{
+		"sessions":       state.Sessions,
+		"wallpapers_set": state.WallpapersSet,
+	}
+	stateMu.Unlock()
+
+	writeJSON(w, map[string]interface{}{
+		"version":   VERSION,
+		"link":      app.Feed(),
+		"connected": app.Connected(),
+		"offline":   app.Offline(),
+		"started":   sessionStart,
+		"current":   currentPost,
+		"settings":  app.Settings(),
+		"stats":     stats,
+		"presence":  presence.Status(),
+		"queue":     wallpapers.Queue.State(),
+	})
+}
+
+func dashboardHistory(w http.ResponseWriter, r *http.Request) {
+	historyMu.Lock()
+	entries := append([]HistoryEntry{}, history...)
+	historyMu.Unlock()
+	writeJSON(w, entries)
+}
+
+func dashboardGallery(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	query := GalleryQuery{
+		SetBy:  q.Get("setter"),
+		Tag:    q.Get("tag"),
+		Artist: q.Get("artist"),
+	}
+	query.LinkID, _ = strconv.Atoi(q.Get("link"))
+
+	gallery, err := loadGallery()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	results := gallery.search(query)
+	// newest first
+	for i, j := 0, len(results)-1; i < j; i, j = i+1, j-1 {
+		results[i], results[j] = results[j], results[i]
+	}
+	writeJSON(w, results)
+}
+
+func galleryEntryFromRequest(id string) (GalleryEntry, bool) {
+	galleryID, err := strconv.Atoi(id)
+	if err != nil {
+		return GalleryEntry{}, false
+	}
+	gallery, err := loadGallery()
+	if err != nil {
+		return GalleryEntry{}, false
+	}
+	return gallery.find(galleryID)
+}
+
+func dashboardGalleryImage(w http.ResponseWriter, r *http.Request) {
+	entry, ok := galleryEntryFromRequest(r.URL.Query().Get("id"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeFile(w, r, entry.File)
+}
+
+func dashboardGalleryApply(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		ID int `json:"id"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	entry, ok := galleryEntryFromRequest(strconv.Itoa(req.ID))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if app.Settings().SafeMode {
+		http.Error(w, "safe mode is on", http.StatusConflict)
+		return
+	}
+	// queued like any other update, so it can't race a post or safe mode
+	wallpapers.Queue.Enqueue(flow.Update{File: entry.File})
+	log.Println("Dashboard set wallpaper to ", entry.File)
+	writeJSON(w, entry)
+}
+
+func dashboardSettings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req settingRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch req.Setting {
+	case "crop", "saveLocally", "discordPresence", "notifications", "safeMode":
+	case "link":
+		if req.LinkID <= 0 {
+			http.Error(w, "invalid link ID", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "unknown setting", http.StatusBadRequest)
+		return
+	}
+
+	select {
+	case settingRequests <- req:
+		log.Println("Dashboard changed setting ", req.Setting)
+		w.WriteHeader(http.StatusNoContent)
+	case <-time.After(5 * time.Second):
+		http.Error(w, "Walltaker is busy, try again", http.StatusServiceUnavailable)
+	}
+}
+
+// dashboardToggleSafeMode flips safe mode, like SIGUSR1 does, for hotkeys
+// where there are no signals
+func dashboardToggleSafeMode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	on := !app.Settings().SafeMode
+	requestSafeMode(on)
+	log.Println("Dashboard toggled safe mode")
+	writeJSON(w, map[string]bool{"safe_mode": on})
+}
@@ -0,0 +1,146 @@
+"use strict";
+
+const $ = (selector) => document.querySelector(selector);
+
+function el(tag, attrs, ...children) {
+  const node = document.createElement(tag);
+  for (const [key, value] of Object.entries(attrs || {})) {
+    if (key === "class") {
+      node.className = value;
+    } else {
+      node.setAttribute(key, value);
+    }
+  }
+  for (const child of children) {
+    node.append(child);
+  }
+  return node;
+}
+
+async function api(path, body) {
+  const options = body === undefined ? {} : {
+    method: "POST",
+    headers: { "Content-Type": "application/json" },
+    body: JSON.stringify(body),
+  };
+  const res = await fetch(path, options);
+  if (!res.ok) {
+    throw new Error(await res.text());
+  }
+  return res.status === 204 ? null : res.json();
+}
+
+function renderTags(post) {
+  const tags = $("#current-tags");
+  tags.replaceChildren();
+  if (!post) {
+    return;
+  }
+  for (const category of ["artist", "character", "species", "copyright", "general"]) {
+    for (const tag of post.tags[category] || []) {
+      tags.append(el("span", { class: "tag " + category }, tag));
+    }
+  }
+}
+
+function renderStatus(status) {
+  const connection = $("#connection");
+  connection.textContent = status.offline ? "offline" : status.connected ? "connected" : "disconnected";
+  connection.className = "badge " + (status.connected ? "ok" : "bad");
+  $("#version").textContent = status.version + " · link " + status.link;
+
+  const current = status.current;
+  if (current) {
+    $("#current-image").src = current.thumbnail_url;
+    $("#current-setter").textContent = "Set by " + current.set_by;
+    const link = $("#current-link");
+    const post = $("#current-post");
+    post.replaceChildren();
+    const source = current.source;
+    link.href = source.page_url;
+    if (source.post) {
+      post.append(el("a", { href: link.href, target: "_blank", rel: "noreferrer" }, source.source + " #" + source.post.id),
+        " · rating " + source.post.rating + " · score " + source.post.score.total);
+    }
+    renderTags(source.post);
+  }
+
+  const form = $("#settings-form");
+  for (const [name, enabled] of Object.entries(status.settings)) {
+    if (form.elements[name] && document.activeElement !== form.elements[name]) {
+      form.elements[name].checked = enabled;
+    }
+  }
+  const linkInput = $("#link-form").elements.link;
+  if (document.activeElement !== linkInput) {
+    linkInput.value = status.link;
+  }
+  $("#stats").textContent = status.stats.wallpapers_set + " wallpapers over " + status.stats.sessions + " sessions";
+}
+
+function card(imageUrl, lines, action) {
+  const node = el("div", { class: "card" }, el("img", { src: imageUrl, loading: "lazy", alt: "" }));
+  for (const line of lines) {
+    node.append(el("div", {}, line));
+  }
+  if (action) {
+    node.append(action);
+  }
+  return node;
+}
+
+function renderHistory(entries) {
+  $("#history-list").replaceChildren(...entries.map((entry) =>
+    card(entry.thumbnail_url, [
+      entry.set_by || "Anonymous",
+      new Date(entry.at).toLocaleTimeString(),
+    ])));
+}
+
+function renderGallery(entries) {
+  $("#gallery-list").replaceChildren(...entries.map((entry) => {
+    const apply = el("button", { type: "button" }, "Set as wallpaper");
+    apply.addEventListener("click", () => api("api/gallery/apply", { id: entry.id }).catch(alert));
+    return card("api/gallery/image?id=" + entry.id, [
+      entry.set_by || "anonymous",
+      new Date(entry.saved_at).toLocaleString(),
+      entry.artists.join(", "),
+    ], apply);
+  }));
+}
+
+async function refresh() {
+  try {
+    renderStatus(await api("api/status"));
+    renderHistory(await api("api/history"));
+  } catch (err) {
+    $("#connection").textContent = "client not running";
+    $("#connection").className = "badge bad";
+  }
+}
+
+async function searchGallery() {
+  const params = new URLSearchParams(new FormData($("#gallery-form")));
+  renderGallery(await api("api/gallery?" + params));
+}
+
+$("#settings-form").addEventListener("change", (event) => {
+  api("api/settings", { setting: event.target.name, enabled: event.target.checked })
+    .then(refresh)
+    .catch(alert);
+});
+
+$("#link-form").addEventListener("submit", (event) => {
+  event.preventDefault();
+  const linkId = parseInt(event.target.elements.link.value, 10);
+  api("api/settings", { setting: "link", link_id: linkId }).then(refresh).catch(alert);
+});
+
+$("#gallery-form").addEventListener("submit", (event) => {
+  event.preventDefault();
+  searchGallery().catch(alert);
+});
+
+refresh();
+searchGallery().catch(() => {});
+setInterval(refresh, 5000);
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"walltaker/flow"
+)
+
+func TestDashboardToggleSafeMode(t *testing.T) {
+	handler := localOnly(http.HandlerFunc(dashboardToggleSafeMode))
+	toggle := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "http://localhost:8621/api/safe-mode/toggle", nil)
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := toggle(); w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+	if on := <-safeModeRequests; !on {
+		t.Error("asked to turn safe mode off while it was off")
+	}
+
+	app.UpdateSettings(func(settings *flow.Settings) { settings.SafeMode = true })
+	t.Cleanup(func() {
+		app.UpdateSettings(func(settings *flow.Settings) { settings.SafeMode = false })
+	})
+	toggle()
+	if on := <-safeModeRequests; on {
+		t.Error("asked to turn safe mode on while it was on")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost:8621/api/safe-mode/toggle", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET got %d", w.Code)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"math/bits"
+	"os"
+	"strconv"
+	"time"
+)
+
+// dedupSimilar also treats re-encoded or resized copies of a saved image as
+// duplicates, using a perceptual hash. Off by default, it has to decode every
+// saved image.
+var dedupSimilar bool = false
+
+// similarImageDistance is how many of the 64 perceptual hash bits may differ
+// for two images to count as the same picture
+const similarImageDistance = 6
+
+// WallpaperSet is one time a saved image was sent as a wallpaper
+type WallpaperSet struct {
+	SetBy  string    `json:"set_by"`
+	LinkID int       `json:"link_id"`
+	SetAt  time.Time `json:"set_at"`
+}
+
+// findByMD5 returns the entry for the image with this MD5, if its file is
+// still around
+func (g *Gallery) findByMD5(md5 string) (GalleryEntry, bool) {
+	if md5 == "" {
+		return GalleryEntry{}, false
+	}
+	for _, entry := range g.Entries {
+		if entry.MD5 == md5 && fileExists(entry.File) {
+			return entry, true
+		}
+	}
+	return GalleryEntry{}, false
+}
+
+// findSimilar returns the entry whose perceptual hash is closest to hash,
+// if it's close enough to be the same picture
+func (g *Gallery) findSimilar(hash uint64) (GalleryEntry, bool) {
+	best, bestDistance := GalleryEntry{}, similarImageDistance+1
+	for _, entry := range g.Entries {
+		if entry.PHash == "" || !fileExists(entry.File) {
+			continue
+		}
+		entryHash, err := strconv.ParseUint(entry.PHash, 16, 64)
+		if err != nil {
+			continue
+		}
+		distance := bits.OnesCount64(hash ^ entryHash)
+		if distance < bestDistance {
+			best, bestDistance = entry, distance
+		}
+	}
+	return best, bestDistance <= similarImageDistance
+}
+
+func fileExists(filename string) bool {
+	_, err := os.Stat(filename)
+	return err == nil
+}
+
+func findDuplicateByMD5(md5 string) (GalleryEntry, bool) {
+	gallery, err := loadGallery()
+	if err != nil {
+		return GalleryEntry{}, false
+	}
+	return gallery.findByMD5(md5)
+}
+
+func findSimilarImage(hash uint64) (GalleryEntry, bool) {
+	gallery, err := loadGallery()
+	if err != nil {
+		return GalleryEntry{}, false
+	}
+	return gallery.findSimilar(hash)
+}
+
+// recordRepeatSet notes that an already saved image was sent again, in both
+// the gallery and the image's sidecar, instead of storing it twice
+func recordRepeatSet(existing GalleryEntry, set WallpaperSet) error {
+	err := updateGallery(func(gallery *Gallery) {
+		for i := range gallery.Entries {
+			if gallery.Entries[i].ID == existing.ID {
+				gallery.Entries[i].Sets = append(gallery.Entries[i].Sets, set)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	metadata, err := readSidecar(existing.File)
+	if err != nil {
+		return err
+	}
+	metadata.Sets = append(metadata.Sets, set)
+	return writeSidecar(existing.File, metadata)
+}
+
+func readSidecar(filename string) (WallpaperMetadata, error) {
+	metadata := WallpaperMetadata{}
+	dat, err := os.ReadFile(sidecarPath(filename))
+	if err != nil {
+		return metadata, err
+	}
+	err = json.Unmarshal(dat, &metadata)
+	return metadata, err
+}
+
+// perceptualHash computes a 64 bit difference hash: the image is shrunk to
+// 9x8 grey pixels and each bit says whether a pixel is brighter than its right
+// neighbour. Re-encoded and resized copies end up with (nearly) the same hash.
+func perceptualHash(filename string) (uint64, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return 0, err
+	}
+	bounds := img.Bounds()
+	if bounds.Dx() < 9 || bounds.Dy() < 8 {
+		return 0, fmt.Errorf("image too small to hash: %dx%d", bounds.Dx(), bounds.Dy())
+	}
+
+	var grey [8][9]float64
+	for y := 0; y < 8; y++ {
+		y0 := bounds.Min.Y + y*bounds.Dy()/8
+		y1 := bounds.Min.Y + (y+1)*bounds.Dy()/8
+		for x := 0; x < 9; x++ {
+			x0 := bounds.Min.X + x*bounds.Dx()/9
+			x1 := bounds.Min.X + (x+1)*bounds.Dx()/9
+			grey[y][x] = averageBrightness(img, x0, y0, x1, y1)
+		}
+	}
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if grey[y][x] > grey[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash, nil
+}
+
+// averageBrightness samples at most 16x16 pixels of the box, which is plenty
+// for a hash this coarse and keeps huge images fast
+func averageBrightness(img image.Image, x0 int, y0 int, x1 int, y1 int) float64 {
+	stepX := (x1-x0)/16 + 1
+	stepY := (y1-y0)/16 + 1
+	total, count := 0.0, 0
+	for y := y0; y < y1; y += stepY {
+		for x := x0; x < x1; x += stepX {
+			r, g, b, _ := img.At(x, y).RGBA()
+			total += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+			count++
+		}
+	}
+	if count == 0 {
+		return 0
+	}
+	return total / float64(count)
+}
+
+func formatPerceptualHash(hash uint64) string {
+	return fmt.Sprintf("%016x", hash)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/hugolgst/rich-go/client"
+)
+
+// discordIPC is the connection to the Discord app presence is shown through
+type discordIPC interface {
+	Login(clientID string) error
+	SetActivity(activity *client.PayloadActivity) error
+	Close() error
+}
+
+// Discord's IPC frames start with these opcodes
+const (
+	discordOpHandshake = 0
+	discordOpFrame     = 1
+	discordOpClose     = 2
+)
+
+const discordIPCTimeout = 5 * time.Second
+
+// ipcClient talks to Discord's IPC socket itself. rich-go's client prints
+// and then ignores write errors, so it can't tell when Discord goes away.
+type ipcClient struct {
+	// dial opens the socket, dialDiscord unless pointed at a fake one
+	dial func() (net.Conn, error)
+	conn net.Conn
+}
+
+func newIPCClient() *ipcClient {
+	return &ipcClient{dial: dialDiscord}
+}
+
+type discordResponse struct {
+	Cmd  string `json:"cmd"`
+	Evt  string `json:"evt"`
+	Code int    `json:"code"`
+	Data struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"data"`
+	Message string `json:"message"`
+}
+
+func (c *ipcClient) Login(clientID string) error {
+	c.Close()
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+
+	res, err := c.send(discordOpHandshake, client.Handshake{V: "1", ClientId: clientID})
+	if err != nil {
+		c.Close()
+		return err
+	}
+	if res.Evt != "READY" {
+		c.Close()
+		return fmt.Errorf("discord did not accept handshake: %s", res.Message)
+	}
+	return nil
+}
+
+func (c *ipcClient) SetActivity(activity *client.PayloadActivity) error {
+	if c.conn == nil {
+		return errors.New("not connected to discord")
+	}
+	res, err := c.send(discordOpFrame, client.Frame{
+		Cmd: "SET_ACTIVITY",
+		Args: client.Args{
+			Pid:      os.Getpid(),
+			Activity: activity,
+		},
+		Nonce: discordNonce(),
+	})
+	if err != nil {
+		return err
+	}
+	if res.Evt == "ERROR" {
+		return fmt.Errorf("discord refused activity: %s", res.Data.Message)
+	}
+	return nil
+}
+
+func (c *ipcClient) Close() error {
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+// send writes one frame and reads Discord's answer to it
+func (c *ipcClient) send(opcode int32, payload interface{}) (discordResponse, error) {
+	res := discordResponse{}
+	dat, err := json.Marshal(payload)
+	if err != nil {
+		return res, err
+	}
+	c.conn.SetDeadline(time.Now().Add(discordIPCTimeout))
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, opcode)
+	binary.Write(buf, binary.LittleEndian, int32(len(dat)))
+	buf.Write(dat)
+	_, err = c.conn.Write(buf.Bytes())
+	if err != nil {
+		return res, err
+	}
+
+	var header struct {
+		Opcode int32
+		Length int32
+	}
+	err = binary.Read(c.conn, binary.LittleEndian, &header)
+	if err != nil {
+		return res, err
+	}
+	body := make([]byte, header.Length)
+	_, err = io.ReadFull(c.conn, body)
+	if err != nil {
+		return res, err
+	}
+	err = json.Unmarshal(body, &res)
+	if err != nil {
+		return res, err
+	}
+	if header.Opcode == discordOpClose {
+		return res, fmt.Errorf("discord closed the connection: %s", res.Message)
+	}
+	return res, nil
+}
+
+func discordNonce() string {
+	return fmt.Sprintf("%d", time.Now().UnixNano())
+}
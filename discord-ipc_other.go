@@ -0,0 +1,41 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// dialDiscord finds Discord's IPC socket, including the Flatpak and Snap
+// locations on Linux
+func dialDiscord() (net.Conn, error) {
+	dirs := []string{}
+	for _, env := range []string{"XDG_RUNTIME_DIR", "TMPDIR", "TMP", "TEMP"} {
+		if dir := os.Getenv(env); dir != "" {
+			dirs = append(dirs, dir)
+		}
+	}
+	dirs = append(dirs, "/tmp")
+
+	for _, dir := range dirs {
+		for _, sub := range []string{"", "app/com.discordapp.Discord", "snap.discord"} {
+			for i := 0; i < 10; i++ {
+				socket := filepath.Join(dir, sub, fmt.Sprintf("discord-ipc-%d", i))
+				if !fileExists(socket) {
+					continue
+				}
+				conn, err := net.DialTimeout("unix", socket, 2*time.Second)
+				if err == nil {
+					return conn, nil
+				}
+			}
+		}
+	}
+	return nil, errors.New("no Discord IPC socket found, is Discord running?")
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	npipe "gopkg.in/natefinch/npipe.v2"
+)
+
+// dialDiscord connects to Discord's named pipe
+func dialDiscord() (net.Conn, error) {
+	for i := 0; i < 10; i++ {
+		// DialTimeout, a plain dial blocks for ages when Discord isn't running
+		conn, err := npipe.DialTimeout(fmt.Sprintf(`\\.\pipe\discord-ipc-%d`, i), 2*time.Second)
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, errors.New("no Discord IPC pipe found, is Discord running?")
+}
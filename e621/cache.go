@@ -0,0 +1,82 @@
+package e621
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// DefaultCacheAge is how long a cached lookup is used before asking e621
+// again. A post's file never changes, but its tags and sizes can.
+const DefaultCacheAge = 7 * 24 * time.Hour
+
+var md5Pattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// Cache keeps lookups by MD5 on disk, one JSON file each in Dir
+type Cache struct {
+	Dir    string
+	MaxAge time.Duration
+}
+
+func NewCache(dir string) *Cache {
+	return &Cache{Dir: dir, MaxAge: DefaultCacheAge}
+}
+
+// Get returns the lookup for md5 and when it was saved, if there is one
+func (c *Cache) Get(md5 string) (PostsData, time.Time, bool) {
+	postsData := PostsData{}
+	file, ok := c.file(md5)
+	if !ok {
+		return postsData, time.Time{}, false
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return postsData, time.Time{}, false
+	}
+	dat, err := os.ReadFile(file)
+	if err != nil || json.Unmarshal(dat, &postsData) != nil {
+		return PostsData{}, time.Time{}, false
+	}
+	return postsData, info.ModTime(), true
+}
+
+// Put saves the lookup for md5
+func (c *Cache) Put(md5 string, postsData PostsData) error {
+	file, ok := c.file(md5)
+	if !ok {
+		return nil
+	}
+	dat, err := json.Marshal(postsData)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(c.Dir, 0755)
+	if err != nil {
+		return err
+	}
+	// written to a temp file first, so a reader never sees half of it
+	tmp, err := os.CreateTemp(c.Dir, md5+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(dat)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// file is where md5's lookup goes. Anything but an MD5 isn't cached, so it
+// can't name a file outside Dir.
+func (c *Cache) file(md5 string) (string, bool) {
+	if c == nil || c.Dir == "" || !md5Pattern.MatchString(md5) {
+		return "", false
+	}
+	return filepath.Join(c.Dir, md5+".json"), true
+}
@@ -0,0 +1,257 @@
+// Package e621 looks up posts on e621, which is where Walltaker's images come
+// from
+package e621
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultBaseURL = "https://e621.net"
+
+// PostsData is the response of posts.json
+type PostsData struct {
+	Posts []Post `json:"posts"`
+}
+
+// Post is an e621 post as returned by posts.json
+type Post struct {
+	ID        int    `json:"id"`
+	CreatedAt string `json:"created_at"`
+	UpdatedAt string `json:"updated_at"`
+	File      struct {
+		Width  int    `json:"width"`
+		Height int    `json:"height"`
+		Ext    string `json:"ext"`
+		Size   int    `json:"size"`
+		Md5    string `json:"md5"`
+		URL    string `json:"url"`
+	} `json:"file"`
+	Preview struct {
+		Width  int    `json:"width"`
+		Height int    `json:"height"`
+		URL    string `json:"url"`
+	} `json:"preview"`
+	Sample struct {
+		Has        bool   `json:"has"`
+		Height     int    `json:"height"`
+		Width      int    `json:"width"`
+		URL        string `json:"url"`
+		Alternates struct {
+		} `json:"alternates"`
+	} `json:"sample"`
+	Score struct {
+		Up    int `json:"up"`
+		Down  int `json:"down"`
+		Total int `json:"total"`
+	} `json:"score"`
+	Tags struct {
+		General   []string      `json:"general"`
+		Species   []string      `json:"species"`
+		Character []string      `json:"character"`
+		Copyright []string      `json:"copyright"`
+		Artist    []string      `json:"artist"`
+		Invalid   []interface{} `json:"invalid"`
+		Lore      []interface{} `json:"lore"`
+		Meta      []string      `json:"meta"`
+	} `json:"tags"`
+	LockedTags []interface{} `json:"locked_tags"`
+	ChangeSeq  int           `json:"change_seq"`
+	Flags      struct {
+		Pending      bool `json:"pending"`
+		Flagged      bool `json:"flagged"`
+		NoteLocked   bool `json:"note_locked"`
+		StatusLocked bool `json:"status_locked"`
+		RatingLocked bool `json:"rating_locked"`
+		Deleted      bool `json:"deleted"`
+	} `json:"flags"`
+	Rating        string        `json:"rating"`
+	FavCount      int           `json:"fav_count"`
+	Sources       []string      `json:"sources"`
+	Pools         []interface{} `json:"pools"`
+	Relationships struct {
+		ParentID          interface{}   `json:"parent_id"`
+		HasChildren       bool          `json:"has_children"`
+		HasActiveChildren bool          `json:"has_active_children"`
+		Children          []interface{} `json:"children"`
+	} `json:"relationships"`
+	ApproverID   int         `json:"approver_id"`
+	UploaderID   int         `json:"uploader_id"`
+	Description  string      `json:"description"`
+	CommentCount int         `json:"comment_count"`
+	IsFavorited  bool        `json:"is_favorited"`
+	HasNotes     bool        `json:"has_notes"`
+	Duration     interface{} `json:"duration"`
+}
+
+// Client talks to e621, or anything serving the same API. Requests are
+// spaced out to stay within e621's rate limit, and lookups by MD5 are kept
+// in Cache if there is one.
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+	// UserAgent is required by e621, requests without one are refused. It
+	// should say who to contact, like "MyProject/1.0 (by username on e621)".
+	UserAgent string
+	// Username and APIKey log in to e621, which finds posts hidden from
+	// guests. Both or neither.
+	Username string
+	APIKey   string
+	// Interval is the least time between requests
+	Interval time.Duration
+	Cache    *Cache
+
+	mu   sync.Mutex
+	next time.Time // when the next request may go out
+}
+
+// DefaultInterval keeps to e621's rate limit: at most two requests a second,
+// and one a second over time
+const DefaultInterval = time.Second
+
+// DefaultBackoff is how long to hold off after e621 says to slow down
+// without saying for how long
+const DefaultBackoff = 5 * time.Second
+
+func NewClient(userAgent string) *Client {
+	return &Client{
+		BaseURL: DefaultBaseURL,
+		HTTPClient: &http.Client{
+			Timeout: time.Second * 2,
+		},
+		UserAgent: userAgent,
+		Interval:  DefaultInterval,
+	}
+}
+
+// PostsByMD5 finds the post whose file has this MD5. A cached lookup is used
+// while it's fresh, and when e621 can't be reached even if it isn't.
+func (c *Client) PostsByMD5(ctx context.Context, md5 string) (PostsData, error) {
+	var cached PostsData
+	var savedAt time.Time
+	var isCached bool
+	if c.Cache != nil {
+		cached, savedAt, isCached = c.Cache.Get(md5)
+		if isCached && time.Since(savedAt) < c.Cache.MaxAge {
+			return cached, nil
+		}
+	}
+
+	postsData, err := c.fetchPostsByMD5(ctx, md5)
+	if err != nil {
+		if isCached {
+			return cached, nil
+		}
+		return postsData, err
+	}
+	// a post that isn't found may still be uploaded, so only hits are kept
+	if c.Cache != nil && len(postsData.Posts) > 0 {
+		c.Cache.Put(md5, postsData)
+	}
+	return postsData, nil
+}
+
+func (c *Client) fetchPostsByMD5(ctx context.Context, md5 string) (PostsData, error) {
+	postsData := PostsData{}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.base()+"/posts.json?tags="+url.QueryEscape("md5:"+md5), nil)
+	if err != nil {
+		return postsData, err
+	}
+	req.Header.Set("User-Agent", c.UserAgent)
+	if c.Username != "" && c.APIKey != "" {
+		req.SetBasicAuth(c.Username, c.APIKey)
+	}
+
+	err = c.wait(ctx)
+	if err != nil {
+		return postsData, err
+	}
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return postsData, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusTooManyRequests || res.StatusCode == http.StatusServiceUnavailable {
+		c.backOff(res.Header.Get("Retry-After"))
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return postsData, fmt.Errorf("e621 returned %s", res.Status)
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return postsData, err
+	}
+	err = json.Unmarshal(body, &postsData)
+	return postsData, err
+}
+
+// wait blocks until the next request may go out, taking its turn
+func (c *Client) wait(ctx context.Context) error {
+	c.mu.Lock()
+	at := c.next
+	if now := time.Now(); at.Before(now) {
+		at = now
+	}
+	c.next = at.Add(c.Interval)
+	c.mu.Unlock()
+
+	delay := time.Until(at)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// backOff holds off requests after e621 said to slow down, for retryAfter
+// seconds if it said how long
+func (c *Client) backOff(retryAfter string) {
+	backoff := DefaultBackoff
+	if seconds, err := strconv.Atoi(retryAfter); err == nil && seconds > 0 {
+		backoff = time.Duration(seconds) * time.Second
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if until := time.Now().Add(backoff); until.After(c.next) {
+		c.next = until
+	}
+}
+
+// PostURL is the page of a post
+func (c *Client) PostURL(id int) string {
+	return fmt.Sprintf("%s/posts/%d", c.base(), id)
+}
+
+// SearchByMD5URL is the search page for a file's MD5
+func (c *Client) SearchByMD5URL(md5 string) string {
+	return c.base() + "/posts?tags=" + url.QueryEscape("md5:"+md5)
+}
+
+func (c *Client) base() string {
+	return strings.TrimRight(c.BaseURL, "/")
+}
+
+// ExtractMD5 returns the MD5 in an e621 file URL, which is its file name
+func ExtractMD5(fileUrl string) string {
+	if fileUrl != "" {
+		md5str := fileUrl[strings.LastIndex(fileUrl, "/")+1:]
+		md5str = strings.Split(md5str, ".")[0]
+		return md5str
+	}
+	return ""
+}
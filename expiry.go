@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"walltaker/config"
+)
+
+// expiryWatcher counts down to the watched link's expiry, warns as it gets
+// close and does what the config says once it has expired
+type expiryWatcher struct {
+	config config.Expiry
+	// expires is the expiry the state below is for; a new link or a renewed
+	// one starts over
+	expires  time.Time
+	warned   int // how many of config.Warnings were sent
+	expired  bool
+	status   string
+	onStatus func(status string)
+}
+
+func newExpiryWatcher(cfg config.Expiry, onStatus func(status string)) *expiryWatcher {
+	return &expiryWatcher{config: cfg, onStatus: onStatus}
+}
+
+// run checks every second until ctx is done
+func (w *expiryWatcher) run(ctx context.Context) {
+	for {
+		w.check(time.Now())
+		if !sleepCtx(ctx, time.Second) {
+			return
+		}
+	}
+}
+
+func (w *expiryWatcher) check(now time.Time) {
+	link := app.Link()
+	if !link.Expires.Equal(w.expires) {
+		w.expires = link.Expires
+		w.warned = 0
+		w.expired = false
+	}
+	if w.expires.IsZero() {
+		w.setStatus("Expires: -")
+		return
+	}
+
+	remaining := w.expires.Sub(now)
+	if remaining <= 0 {
+		w.setStatus("Link expired")
+		if !w.expired {
+			w.expired = true
+			w.expire(int64(link.ID))
+		}
+		return
+	}
+	w.setStatus("Expires in " + formatRemaining(remaining))
+
+	// Warnings are longest first, so the ones that are due come first. If
+	// several came due at once, e.g. on startup, only warn once.
+	due := 0
+	for _, warning := range w.config.Warnings {
+		if remaining <= warning {
+			due++
+		}
+	}
+	if due > w.warned {
+		w.warned = due
+		log.Println("Link ", link.ID, " expires in ", formatRemaining(remaining))
+		sendNotification(Notification{
+			Event:  "expiry",
+			Title:  "Walltaker",
+			Body:   fmt.Sprintf("Your link expires in %s!", formatRemaining(remaining)),
+			LinkID: link.ID,
+		})
+	}
+}
+
+// expire does what the config says to once link id has expired
+func (w *expiryWatcher) expire(id int64) {
+	body := "Your link expired."
+	switch w.config.OnExpire {
+	case config.ExpireRestore:
+		body += " Your original wallpaper is back."
+	case config.ExpireFallback:
+		body += fmt.Sprintf(" Switching to link %d.", w.config.FallbackLink)
+	}
+	log.Println("Link ", id, " expired, doing: ", w.config.OnExpire)
+	sendNotification(Notification{
+		Event:  "expiry",
+		Title:  "Walltaker",
+		Body:   body,
+		LinkID: int(id),
+	})
+
+	switch w.config.OnExpire {
+	case config.ExpireRestore:
+		wallpapers.QueueRestore()
+	case config.ExpireFallback:
+		if id == w.config.FallbackLink {
+			log.Println("The fallback link expired too, keeping the last wallpaper")
+			return
+		}
+		// the menu loop owns switching links
+		go func() {
+			select {
+			case settingRequests <- settingRequest{Setting: "link", LinkID: w.config.FallbackLink}:
+			case <-rootCtx.Done():
+			}
+		}()
+	}
+}
+
+func (w *expiryWatcher) setStatus(status string) {
+	if status == w.status {
+		return
+	}
+	w.status = status
+	if w.onStatus != nil {
+		w.onStatus(status)
+	}
+}
+
+// formatRemaining shows time left like "2h 5m" or "3d 4h"
+func formatRemaining(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return "under a minute"
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh %dm", int(d.Hours()), int(d.Minutes())%60)
+	}
+	return fmt.Sprintf("%dd %dh", int(d.Hours())/24, int(d.Hours())%24)
+}
@@ -0,0 +1,406 @@
+// Package fakeserver is a stand-in for Walltaker and e621, for running the
+// client end to end without either. It serves /links/<id>.json, a user's
+// links, setting and responding to links with an API key, the ActionCable
+// endpoint at /cable, e621's /posts.json and the images themselves, and
+// pushes a link to whoever subscribed when it changes.
+package fakeserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"walltaker/e621"
+
+	"github.com/PawCorp/walltaker-desktop-client/walltaker"
+	"github.com/gorilla/websocket"
+	"github.com/guregu/null"
+)
+
+// pingInterval is how often ActionCable pings, clients call the connection
+// stale when pings stop
+const pingInterval = 3 * time.Second
+
+// Server is a fake Walltaker and e621 on a local port. Set the BaseURL of
+// both the walltaker and the e621 client to URL.
+type Server struct {
+	URL string
+
+	server   *httptest.Server
+	upgrader websocket.Upgrader
+
+	mu          sync.Mutex
+	links       map[int]walltaker.Link
+	posts       map[string]e621.Post
+	images      map[string][]byte
+	subscribers map[*cableConn]map[string]int // identifier -> link ID
+	apiKeys     map[string]string             // API key -> username
+	requests    []string
+}
+
+// cableConn is one ActionCable connection. gorilla/websocket allows one
+// writer at a time, so every write goes through send.
+type cableConn struct {
+	ws *websocket.Conn
+	mu sync.Mutex
+}
+
+func (c *cableConn) send(v interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ws.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	return c.ws.WriteJSON(v)
+}
+
+// New starts a fake server. Close it when done.
+func New() *Server {
+	s := &Server{
+		links:       map[int]walltaker.Link{},
+		posts:       map[string]e621.Post{},
+		images:      map[string][]byte{},
+		subscribers: map[*cableConn]map[string]int{},
+		apiKeys:     map[string]string{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/links/", s.serveLink)
+	mux.HandleFunc("/api/users/", s.serveUserLinks)
+	mux.HandleFunc("/api/links/", s.serveLinkAction)
+	mux.HandleFunc("/cable", s.serveCable)
+	mux.HandleFunc("/posts.json", s.servePosts)
+	mux.HandleFunc("/images/", s.serveImage)
+	s.server = httptest.NewServer(s.record(mux))
+	s.URL = s.server.URL
+	return s
+}
+
+// Close shuts the server down, dropping every connection
+func (s *Server) Close() {
+	s.mu.Lock()
+	for conn := range s.subscribers {
+		conn.ws.Close()
+	}
+	s.mu.Unlock()
+	s.server.CloseClientConnections()
+	s.server.Close()
+}
+
+// SetLink stores link and pushes it to everyone subscribed to it, the way
+// Walltaker does when somebody sets a wallpaper
+func (s *Server) SetLink(link walltaker.Link) {
+	if link.UpdatedAt.IsZero() {
+		link.UpdatedAt = time.Now()
+	}
+	s.mu.Lock()
+	s.links[link.ID] = link
+	var targets []*cableConn
+	var identifiers []string
+	for conn, subscriptions := range s.subscribers {
+		for identifier, id := range subscriptions {
+			if id == link.ID {
+				targets = append(targets, conn)
+				identifiers = append(identifiers, identifier)
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	for i, conn := range targets {
+		conn.send(map[string]interface{}{
+			"identifier": identifiers[i],
+			"message":    link,
+		})
+	}
+}
+
+// AddUser lets username act with apiKey
+func (s *Server) AddUser(username string, apiKey string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.apiKeys[apiKey] = username
+}
+
+// Link returns a link as it is now
+func (s *Server) Link(id int) (walltaker.Link, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	link, ok := s.links[id]
+	return link, ok
+}
+
+// AddPost makes post findable by its MD5 on /posts.json
+func (s *Server) AddPost(post e621.Post) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.posts[post.File.Md5] = post
+}
+
+// AddImage serves data at /images/<name> and returns its URL, for use as a
+// post URL
+func (s *Server) AddImage(name string, data []byte) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.images[name] = data
+	return s.URL + "/images/" + name
+}
+
+// Subscribers counts the cable subscriptions to a link
+func (s *Server) Subscribers(id int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count := 0
+	for _, subscriptions := range s.subscribers {
+		for _, subscribed := range subscriptions {
+			if subscribed == id {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// WaitForSubscriber waits until somebody subscribes to a link, so a SetLink
+// after it is sure to be pushed
+func (s *Server) WaitForSubscriber(id int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if s.Subscribers(id) > 0 {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+// Requests lists "METHOD /path" for every request so far
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.requests...)
+}
+
+func (s *Server) record(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests = append(s.requests, r.Method+" "+r.URL.Path)
+		s.mu.Unlock()
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) serveLink(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/links/")
+	id, err := strconv.Atoi(strings.TrimSuffix(name, ".json"))
+	if err != nil || !strings.HasSuffix(name, ".json") {
+		http.NotFound(w, r)
+		return
+	}
+	s.mu.Lock()
+	link, ok := s.links[id]
+	s.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, link)
+}
+
+// serveUserLinks lists the links of a user, by Link.Username
+func (s *Server) serveUserLinks(w http.ResponseWriter, r *http.Request) {
+	username := strings.TrimPrefix(r.URL.Path, "/api/users/")
+	if !strings.HasSuffix(username, "/links.json") {
+		http.NotFound(w, r)
+		return
+	}
+	username = strings.TrimSuffix(username, "/links.json")
+	links := []walltaker.Link{}
+	s.mu.Lock()
+	for _, link := range s.links {
+		if link.Username == username {
+			links = append(links, link)
+		}
+	}
+	s.mu.Unlock()
+	sort.Slice(links, func(i, j int) bool {
+		return links[i].ID < links[j].ID
+	})
+	writeJSON(w, links)
+}
+
+// serveLinkAction sets a link's wallpaper to a post, POST
+// /api/links/<id>.json, or responds to it, POST /api/links/<id>/response.json
+func (s *Server) serveLinkAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/api/links/")
+	response := strings.HasSuffix(name, "/response.json")
+	id, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSuffix(name, "/response.json"), ".json"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	var body struct {
+		APIKey string `json:"api_key"`
+		PostID int    `json:"post_id"`
+		Type   string `json:"type"`
+		Text   string `json:"text"`
+	}
+	if json.NewDecoder(r.Body).Decode(&body) != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	username, authorized := s.apiKeys[body.APIKey]
+	link, found := s.links[id]
+	var post e621.Post
+	postFound := false
+	for _, p := range s.posts {
+		if p.ID == body.PostID {
+			post, postFound = p, true
+		}
+	}
+	s.mu.Unlock()
+
+	switch {
+	case !authorized:
+		http.Error(w, "invalid api key", http.StatusUnauthorized)
+		return
+	case !found:
+		http.NotFound(w, r)
+		return
+	case response && link.Username != username:
+		http.Error(w, "only the owner of a link can respond to it", http.StatusForbidden)
+		return
+	case response:
+		link.ResponseType = null.StringFrom(body.Type)
+		link.ResponseText = null.StringFrom(body.Text)
+	case !postFound:
+		http.Error(w, "post not found", http.StatusNotFound)
+		return
+	default:
+		link.PostURL = null.StringFrom(post.File.URL)
+		link.PostThumbnailURL = null.StringFrom(post.Preview.URL)
+		link.SetBy = null.StringFrom(username)
+		link.ResponseType = null.String{}
+		link.ResponseText = null.String{}
+	}
+	link.UpdatedAt = time.Now()
+	s.SetLink(link)
+	writeJSON(w, link)
+}
+
+func (s *Server) servePosts(w http.ResponseWriter, r *http.Request) {
+	data := e621.PostsData{Posts: []e621.Post{}}
+	for _, tag := range strings.Fields(r.URL.Query().Get("tags")) {
+		if !strings.HasPrefix(tag, "md5:") {
+			continue
+		}
+		s.mu.Lock()
+		post, ok := s.posts[strings.TrimPrefix(tag, "md5:")]
+		s.mu.Unlock()
+		if ok {
+			data.Posts = append(data.Posts, post)
+		}
+	}
+	writeJSON(w, data)
+}
+
+func (s *Server) serveImage(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	data, ok := s.images[strings.TrimPrefix(r.URL.Path, "/images/")]
+	s.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Write(data)
+}
+
+// serveCable speaks just enough ActionCable for LinkChannel: welcome,
+// subscribe/unsubscribe, pings and pushed messages
+func (s *Server) serveCable(w http.ResponseWriter, r *http.Request) {
+	ws, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	conn := &cableConn{ws: ws}
+	s.mu.Lock()
+	s.subscribers[conn] = map[string]int{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.subscribers, conn)
+		s.mu.Unlock()
+		ws.Close()
+	}()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(pingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if conn.send(map[string]interface{}{"type": "ping", "message": time.Now().Unix()}) != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	if conn.send(map[string]string{"type": "welcome"}) != nil {
+		return
+	}
+	for {
+		var command struct {
+			Command    string `json:"command"`
+			Identifier string `json:"identifier"`
+		}
+		if err := ws.ReadJSON(&command); err != nil {
+			return
+		}
+		var identifier struct {
+			Channel string      `json:"channel"`
+			ID      json.Number `json:"id"`
+		}
+		err := json.Unmarshal([]byte(command.Identifier), &identifier)
+		id, idErr := identifier.ID.Int64()
+		if err != nil || idErr != nil || identifier.Channel != "LinkChannel" {
+			conn.send(map[string]string{"type": "reject_subscription", "identifier": command.Identifier})
+			continue
+		}
+
+		switch command.Command {
+		case "subscribe":
+			s.mu.Lock()
+			s.subscribers[conn][command.Identifier] = int(id)
+			s.mu.Unlock()
+			conn.send(map[string]string{"type": "confirm_subscription", "identifier": command.Identifier})
+		case "unsubscribe":
+			s.mu.Lock()
+			delete(s.subscribers[conn], command.Identifier)
+			s.mu.Unlock()
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	dat, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(dat)
+}
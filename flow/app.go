@@ -0,0 +1,200 @@
+// Package flow takes wallpapers from Walltaker to the desktop: it watches a
+// link, queues every new post and sets it through a backend. The App it
+// keeps is the state the rest of the client shares and subscribes to.
+package flow
+
+import (
+	"sync"
+
+	"github.com/PawCorp/walltaker-desktop-client/walltaker"
+)
+
+// Settings are the toggles in the tray menu
+type Settings struct {
+	Crop            bool `json:"crop"`
+	SaveLocally     bool `json:"saveLocally"`
+	DiscordPresence bool `json:"discordPresence"`
+	Notifications   bool `json:"notifications"`
+	// SafeMode is on while the user is screen sharing or presenting: no
+	// wallpaper changes, no notifications and no Discord presence
+	SafeMode bool `json:"safeMode"`
+}
+
+// AppEvent says what changed in the App
+type AppEvent struct {
+	// Kind is EventPost, EventLink, EventSettings, EventFeed, EventConnection
+	// or EventOffline
+	Kind      string
+	Post      walltaker.Link
+	Link      walltaker.Link
+	Settings  Settings
+	Previous  Settings
+	Feed      int64
+	Connected bool
+	Offline   bool
+}
+
+const (
+	EventPost       = "post"
+	EventLink       = "link"
+	EventSettings   = "settings"
+	EventFeed       = "feed"
+	EventConnection = "connection"
+	EventOffline    = "offline"
+)
+
+// App is the state shared by the cable handler, the wallpaper goroutines,
+// the tray and the dashboard. It's only touched through its methods, and
+// whoever needs to react to a change subscribes instead of polling globals.
+type App struct {
+	mu          sync.RWMutex
+	feed        int64
+	settings    Settings
+	currentPost walltaker.Link
+	link        walltaker.Link
+	connected   bool
+	offline     bool
+	listeners   []func(AppEvent)
+}
+
+// NewApp starts with settings, watching no link
+func NewApp(settings Settings) *App {
+	return &App{settings: settings}
+}
+
+// Subscribe calls listener with every change from now on. Listeners run on
+// the goroutine that made the change, without the App locked, so they may
+// read it but should be quick.
+func (a *App) Subscribe(listener func(event AppEvent)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.listeners = append(a.listeners, listener)
+}
+
+func (a *App) emit(event AppEvent) {
+	a.mu.RLock()
+	listeners := append([]func(AppEvent){}, a.listeners...)
+	a.mu.RUnlock()
+	for _, listener := range listeners {
+		listener(event)
+	}
+}
+
+func (a *App) Settings() Settings {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.settings
+}
+
+// UpdateSettings lets update change the settings, and tells listeners if it did
+func (a *App) UpdateSettings(update func(settings *Settings)) Settings {
+	a.mu.Lock()
+	previous := a.settings
+	update(&a.settings)
+	settings := a.settings
+	a.mu.Unlock()
+
+	if settings != previous {
+		a.emit(AppEvent{Kind: EventSettings, Settings: settings, Previous: previous})
+	}
+	return settings
+}
+
+func (a *App) Feed() int64 {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.feed
+}
+
+func (a *App) SetFeed(feed int64) {
+	a.mu.Lock()
+	changed := a.feed != feed
+	a.feed = feed
+	a.mu.Unlock()
+
+	if changed {
+		a.emit(AppEvent{Kind: EventFeed, Feed: feed})
+	}
+}
+
+func (a *App) CurrentPost() walltaker.Link {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.currentPost
+}
+
+// SetCurrentPost makes post the current wallpaper. It returns false, and
+// changes nothing, if that post is already current.
+func (a *App) SetCurrentPost(post walltaker.Link) bool {
+	a.mu.Lock()
+	if post.PostURL.String == a.currentPost.PostURL.String {
+		a.mu.Unlock()
+		return false
+	}
+	a.currentPost = post
+	a.mu.Unlock()
+
+	a.emit(AppEvent{Kind: EventPost, Post: post})
+	return true
+}
+
+// Link is the watched link as Walltaker last sent it. Unlike CurrentPost it
+// changes with every update, like a new expiry or terms, not only new posts.
+func (a *App) Link() walltaker.Link {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.link
+}
+
+// SetLink records the latest state of the watched link
+func (a *App) SetLink(link walltaker.Link) {
+	a.mu.Lock()
+	changed := a.link != link
+	a.link = link
+	a.mu.Unlock()
+
+	if changed {
+		a.emit(AppEvent{Kind: EventLink, Link: link})
+	}
+}
+
+// SetterName is who set the current wallpaper, empty if anonymous
+func (a *App) SetterName() string {
+	return a.CurrentPost().SetBy.String
+}
+
+func (a *App) Connected() bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.connected
+}
+
+func (a *App) SetConnected(connected bool) {
+	a.mu.Lock()
+	changed := a.connected != connected
+	a.connected = connected
+	a.mu.Unlock()
+
+	if changed {
+		a.emit(AppEvent{Kind: EventConnection, Connected: connected})
+	}
+}
+
+// Offline is true while Walltaker can't be reached and the last known
+// wallpaper is all we have
+func (a *App) Offline() bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.offline
+}
+
+func (a *App) SetOffline(offline bool) {
+	a.mu.Lock()
+	changed := a.offline != offline
+	a.offline = offline
+	a.mu.Unlock()
+
+	if changed {
+		a.emit(AppEvent{Kind: EventOffline, Offline: offline})
+	}
+}
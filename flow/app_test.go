@@ -0,0 +1,118 @@
+package flow
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/PawCorp/walltaker-desktop-client/walltaker"
+	"github.com/guregu/null"
+)
+
+func TestAppEmitsChanges(t *testing.T) {
+	app := NewApp(Settings{Crop: true})
+	var events []AppEvent
+	app.Subscribe(func(event AppEvent) {
+		events = append(events, event)
+	})
+
+	app.SetFeed(123)
+	app.SetFeed(123)
+	post := walltaker.Link{ID: 123, PostURL: null.StringFrom("https://example.com/a.png")}
+	if !app.SetCurrentPost(post) {
+		t.Error("a new post should be set")
+	}
+	if app.SetCurrentPost(post) {
+		t.Error("the same post shouldn't be set again")
+	}
+	app.UpdateSettings(func(settings *Settings) {
+		settings.SafeMode = true
+	})
+	app.UpdateSettings(func(settings *Settings) {})
+	app.SetConnected(true)
+	app.SetOffline(true)
+
+	kinds := []string{}
+	for _, event := range events {
+		kinds = append(kinds, event.Kind)
+	}
+	want := []string{EventFeed, EventPost, EventSettings, EventConnection, EventOffline}
+	if fmt.Sprint(kinds) != fmt.Sprint(want) {
+		t.Fatalf("got events %v, want %v", kinds, want)
+	}
+	if settings := events[2]; !settings.Settings.SafeMode || settings.Previous.SafeMode || !settings.Settings.Crop {
+		t.Errorf("got settings event %+v", settings)
+	}
+}
+
+// TestAppConcurrentUse is for the race detector: go test -race
+func TestAppConcurrentUse(t *testing.T) {
+	app := NewApp(Settings{})
+	var seen int64
+	var wg sync.WaitGroup
+	const workers = 8
+	const rounds = 200
+	const listeners = 20
+
+	for w := 0; w < workers; w++ {
+		wg.Add(5)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < listeners; i++ {
+				app.Subscribe(func(event AppEvent) {
+					atomic.AddInt64(&seen, 1)
+					// listeners may read the app
+					app.Settings()
+					app.CurrentPost()
+				})
+			}
+		}()
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				app.SetCurrentPost(walltaker.Link{ID: w, PostURL: null.StringFrom(fmt.Sprintf("https://example.com/%d-%d.png", w, i))})
+				app.SetLink(walltaker.Link{ID: w, Terms: fmt.Sprint(i)})
+			}
+		}(w)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				app.UpdateSettings(func(settings *Settings) {
+					settings.SafeMode = !settings.SafeMode
+					settings.Crop = i%2 == 0
+				})
+			}
+		}()
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				app.SetFeed(int64(w*rounds + i))
+				app.SetConnected(i%2 == 0)
+				app.SetOffline(i%3 == 0)
+			}
+		}(w)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				app.Feed()
+				app.Link()
+				app.SetterName()
+				app.Connected()
+				app.Offline()
+				app.Settings()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if atomic.LoadInt64(&seen) == 0 {
+		t.Error("no listener saw an event")
+	}
+	// everything settled: a change now reaches every listener exactly once
+	before := atomic.LoadInt64(&seen)
+	app.SetFeed(-1)
+	if got := atomic.LoadInt64(&seen) - before; got != workers*listeners {
+		t.Errorf("%d listeners were told, want %d", got, workers*listeners)
+	}
+}
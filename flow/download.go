@@ -0,0 +1,69 @@
+package flow
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+// downloadImageForMac downloads url to a temp file. Cancelling ctx stops the
+// download.
+func downloadImageForMac(ctx context.Context, url string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return "", errors.New("non-200 status code")
+	}
+
+	file, err := ioutil.TempFile("", "walltakerbg")
+	if err != nil {
+		return "", err
+	}
+
+	_, err = io.Copy(file, res.Body)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return "", err
+	}
+
+	err = file.Close()
+	if err != nil {
+		return "", err
+	}
+
+	return file.Name(), nil
+}
+
+func cleanUpCacheForMac(file string) error {
+	return os.Remove(file)
+}
+
+// CopyFile copies src to dst, replacing dst
+func CopyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,476 @@
+package flow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"walltaker/backend"
+
+	"github.com/PawCorp/walltaker-desktop-client/walltaker"
+)
+
+// Hooks let the rest of the client act on what the flow does. Any of them
+// may be nil.
+type Hooks struct {
+	// Applied reports whether post was the last one applied from its link,
+	// maybe in an earlier run
+	Applied func(post walltaker.Link) bool
+	// Record remembers post as applied
+	Record func(post walltaker.Link)
+	// NewPost is called in the background for every post not applied yet
+	NewPost func(post walltaker.Link)
+	// OnScreen reports whether an applied post is still up from before, e.g.
+	// after a crash. It's only asked about the first post of a link.
+	OnScreen func(post walltaker.Link) bool
+	// WallpaperURL picks what to download for a post URL on Windows
+	WallpaperURL func(postURL string) string
+	// Downloaded gets every image downloaded, from url, for the post at
+	// postURL
+	Downloaded func(file string, url string, postURL string)
+	// Notify tells the user about a new wallpaper
+	Notify func(post walltaker.Link, setAt string)
+	// Save keeps a post, when saving locally is on
+	Save func(post walltaker.Link, setAt string)
+	// Offline is called whenever Walltaker can't be reached
+	Offline func()
+	// Original returns the file of the original wallpaper, "" if unknown
+	Original func() string
+}
+
+// Flow puts the posts of the watched link on the desktop. Updates go through
+// Queue, so they never race each other.
+type Flow struct {
+	Client  *walltaker.Client
+	Backend backend.Backend
+	App     *App
+	Queue   *Queue
+	Hooks   Hooks
+	// Dir keeps the current wallpaper on Windows, which reads the file
+	// again when switching between crop and fit
+	Dir string
+
+	ctx          context.Context
+	watchMu      sync.Mutex
+	cable        *walltaker.Cable
+	subscription *walltaker.Subscription
+	// stopFollowing cancels the follow of the link watched before
+	stopFollowing context.CancelFunc
+	followMu      sync.Mutex
+	// waitingForPost is set while follow is fetching the link
+	waitingForPost int32
+}
+
+// New makes a flow that watches links with client and sets their posts on
+// b, keeping its state in app. It stops when ctx is done.
+func New(ctx context.Context, client *walltaker.Client, b backend.Backend, app *App) *Flow {
+	f := &Flow{
+		Client:        client,
+		Backend:       b,
+		App:           app,
+		ctx:           ctx,
+		stopFollowing: func() {},
+	}
+	f.Queue = NewQueue(ctx, f.apply)
+	return f
+}
+
+// Connect opens the cable to Walltaker, it's closed when the flow stops
+func (f *Flow) Connect() error {
+	cable, err := f.Client.Connect(f.ctx)
+	if err != nil {
+		return err
+	}
+	f.watchMu.Lock()
+	f.cable = cable
+	f.watchMu.Unlock()
+	return nil
+}
+
+// Watch switches the subscription over to link id, connecting first if
+// Connect wasn't called or failed
+func (f *Flow) Watch(id int64) error {
+	f.watchMu.Lock()
+	defer f.watchMu.Unlock()
+
+	if f.cable == nil {
+		cable, err := f.Client.Connect(f.ctx)
+		if err != nil {
+			return err
+		}
+		f.cable = cable
+	}
+	if f.subscription != nil {
+		f.subscription.Unsubscribe() // unsubscribe from previous channel
+		f.subscription = nil
+	}
+	subscription, err := f.cable.Subscribe(id, walltaker.Handler{
+		Update: f.Received,
+		Connected: func() {
+			fmt.Println("on connected")
+			f.App.SetConnected(true)
+		},
+		Disconnected: func() {
+			fmt.Println("on disconnected")
+			f.App.SetConnected(false)
+		},
+		Rejected: func() {
+			fmt.Println("on rejected")
+		},
+	})
+	if err != nil {
+		return err
+	}
+	f.subscription = subscription
+	return nil
+}
+
+// Received handles a link pushed by Walltaker
+func (f *Flow) Received(userData walltaker.Link) {
+	log.Println("New Image... ")
+	f.App.SetLink(userData)
+	if f.isApplied(userData) {
+		log.Println("Already applied this post, skipping")
+		return
+	}
+	if f.App.SetCurrentPost(userData) {
+		setterName := userData.SetBy.String
+		setAt := strings.ReplaceAll(time.Now().Format(time.RFC3339), ":", "-")
+		if setterName != "" {
+			log.Printf(setterName)
+			log.Printf(" set your wallpaper! Setting... ")
+		} else {
+			log.Printf("New wallpaper found! Setting... ")
+		}
+		f.Queue.Enqueue(Update{
+			Post:        userData,
+			SetAt:       setAt,
+			SaveLocally: f.App.Settings().SaveLocally,
+			Notify:      true,
+			Record:      true,
+		})
+		if f.Hooks.NewPost != nil {
+			go f.Hooks.NewPost(userData)
+		}
+	}
+}
+
+// Follow follows the watched link in the background, instead of whatever
+// link was followed before. A link without a post can take forever, so it
+// must not hold up the caller.
+func (f *Flow) Follow() {
+	f.followMu.Lock()
+	defer f.followMu.Unlock()
+	f.stopFollowing()
+	ctx, cancel := context.WithCancel(f.ctx)
+	f.stopFollowing = cancel
+	go f.follow(ctx)
+}
+
+// WaitingForPost is true while Follow is fetching the link. That catches up
+// after an outage by itself.
+func (f *Flow) WaitingForPost() bool {
+	return atomic.LoadInt32(&f.waitingForPost) > 0
+}
+
+// follow puts up the post of the watched link once it has one
+func (f *Flow) follow(ctx context.Context) {
+	userData, ok := f.waitForPost(ctx)
+	if !ok || ctx.Err() != nil {
+		return
+	}
+
+	setterName := userData.SetBy.String
+	setAt := strings.ReplaceAll(time.Now().Format(time.RFC3339), ":", "-")
+	if setterName != "" {
+		log.Printf(setterName)
+		log.Printf(" set your initial wallpaper: Setting... ")
+	} else {
+		log.Printf("Anonymous set your initial wallpaper: Setting... ")
+	}
+	f.App.SetLink(userData)
+	f.App.SetCurrentPost(userData)
+	if !f.isApplied(userData) && f.Hooks.NewPost != nil {
+		go f.Hooks.NewPost(userData)
+	}
+	f.applyInitialPost(userData, setAt)
+
+	log.Printf("Set!")
+
+	f.SetMode(f.App.Settings().Crop)
+}
+
+// waitForPost fetches the watched link until it has a post, checking again
+// every 5 seconds. It returns false if ctx is done first. While Walltaker
+// can't be reached we're offline, with the last known post up.
+func (f *Flow) waitForPost(ctx context.Context) (walltaker.Link, bool) {
+	atomic.AddInt32(&f.waitingForPost, 1)
+	defer atomic.AddInt32(&f.waitingForPost, -1)
+	for {
+		feed := f.App.Feed() // account for runtime change of link ID
+		userData, err := f.Client.GetLink(ctx, feed)
+		if f.isOfflineError(err) {
+			log.Println("Could not reach Walltaker: ", err)
+			if f.Hooks.Offline != nil {
+				f.Hooks.Offline()
+			}
+		} else if err != nil {
+			log.Println("Could not get link ", feed, ": ", err)
+		}
+		if err == nil {
+			f.App.SetOffline(false)
+			if userData.PostURL.String != "" {
+				return userData, true
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return userData, false
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// isOfflineError tells a network failure apart from Walltaker answering with
+// an error
+func (f *Flow) isOfflineError(err error) bool {
+	var statusErr *walltaker.StatusError
+	return err != nil && !errors.As(err, &statusErr) && f.ctx.Err() == nil
+}
+
+func (f *Flow) isApplied(userData walltaker.Link) bool {
+	return f.Hooks.Applied != nil && f.Hooks.Applied(userData)
+}
+
+// applyInitialPost applies the post a link has when we start watching it. A
+// post we already applied in an earlier run is not notified about or saved
+// again, and not even set if it is still on screen after a crash or from
+// offline mode.
+func (f *Flow) applyInitialPost(userData walltaker.Link, setAt string) {
+	// only true for the very first post
+	onScreen := f.Hooks.OnScreen != nil && f.Hooks.OnScreen(userData)
+	if !f.isApplied(userData) {
+		f.Queue.Enqueue(Update{
+			Post:        userData,
+			SetAt:       setAt,
+			SaveLocally: f.App.Settings().SaveLocally,
+			Notify:      true,
+			Record:      true,
+		})
+		return
+	}
+	log.Println("Post is unchanged since last run, not applying it again")
+	if !onScreen {
+		// the original wallpaper was restored on exit, so put the post back up
+		f.Queue.Enqueue(Update{Post: userData, SetAt: setAt})
+	}
+}
+
+// QueueRestore puts the original wallpaper back after, and instead of,
+// whatever post is still on its way
+func (f *Flow) QueueRestore() {
+	f.Queue.Enqueue(Update{Restore: true})
+}
+
+// apply is what the queue runs for every update
+func (f *Flow) apply(ctx context.Context, update Update) error {
+	if update.Restore {
+		f.RestoreOriginal()
+		return nil
+	}
+	if update.File != "" {
+		_, err := f.setLocalWallpaper(update.File)
+		return err
+	}
+	applied, err := f.setWallpaper(ctx, update.Post, update.SaveLocally, update.SetAt, update.Notify)
+	if err != nil {
+		return err
+	}
+	// a post held back by safe mode is still new once it's turned off
+	if applied && update.Record && f.Hooks.Record != nil {
+		f.Hooks.Record(update.Post)
+	}
+	return nil
+}
+
+// setWallpaper puts a post on screen and reports whether it did; safe mode
+// holds it back. Don't call it directly, enqueue an Update so updates never
+// race each other. If ctx is cancelled before the download finishes nothing
+// is set, notified or saved.
+func (f *Flow) setWallpaper(ctx context.Context, userData walltaker.Link, saveLocally bool, setAt string, notify bool) (bool, error) {
+	url := userData.PostURL.String
+	if f.App.Settings().SafeMode {
+		log.Println("Safe mode is on, not changing wallpaper")
+		if saveLocally {
+			f.save(userData, setAt)
+		}
+		return false, nil
+	}
+
+	err := clearWindowsWallpaperCache()
+	if err != nil {
+		// the new wallpaper may well show anyway
+		log.Println("Could not clear the Windows wallpaper cache: ", err)
+	}
+	if runtime.GOOS == "windows" && f.Hooks.WallpaperURL != nil {
+		url = f.Hooks.WallpaperURL(url)
+	}
+	file, err := downloadImageForMac(ctx, url)
+	if ctx.Err() != nil {
+		if err == nil {
+			cleanUpCacheForMac(file)
+		}
+		return false, ctx.Err()
+	}
+	if err != nil {
+		log.Println("Ouch! Had a problem while downloading your wallpaper.")
+		log.Println("Full error: ", err)
+		return false, err
+	}
+	if f.Hooks.Downloaded != nil {
+		f.Hooks.Downloaded(file, url, userData.PostURL.String)
+	}
+	applied, err := f.setWallpaperFile(file, url)
+	if err != nil {
+		return false, err
+	}
+
+	if applied && notify && f.Hooks.Notify != nil {
+		f.Hooks.Notify(userData, setAt)
+	}
+
+	if saveLocally {
+		f.save(userData, setAt)
+	}
+	return applied, nil
+}
+
+func (f *Flow) save(userData walltaker.Link, setAt string) {
+	if f.Hooks.Save != nil {
+		f.Hooks.Save(userData, setAt)
+	}
+}
+
+// setWallpaperFile puts a downloaded file, from url, up as the wallpaper,
+// unless safe mode was turned on during the download. The file is moved or
+// removed afterwards.
+func (f *Flow) setWallpaperFile(file string, url string) (bool, error) {
+	if f.App.Settings().SafeMode {
+		log.Println("Safe mode is on, not changing wallpaper")
+		cleanUpCacheForMac(file)
+		return false, nil
+	}
+	var err error
+	if runtime.GOOS == "windows" {
+		// Windows reads the file again when switching between crop and fit
+		file, err = f.keepWallpaperFile(file, url)
+		if err != nil {
+			return false, err
+		}
+	} else {
+		defer cleanUpCacheForMac(file) // OK to delete after setting wallpaper, MacOS shows bg w/o file remaining there
+	}
+	err = f.Backend.SetFromFile(file)
+	if err != nil {
+		log.Println("Ouch! Had a problem while setting your wallpaper.")
+		log.Println("Full error: ", err)
+		return false, err
+	}
+	return true, nil
+}
+
+// keepWallpaperFile moves a downloaded wallpaper to Dir, where the current
+// one is kept
+func (f *Flow) keepWallpaperFile(file string, url string) (string, error) {
+	if f.Dir == "" {
+		return file, nil
+	}
+	kept := filepath.Join(f.Dir, "current-wallpaper"+path.Ext(url))
+	err := os.Rename(file, kept)
+	if err != nil {
+		// temp may be on another drive
+		err = CopyFile(file, kept)
+		cleanUpCacheForMac(file)
+	}
+	return kept, err
+}
+
+// setLocalWallpaper puts a local image up, like the kept offline copy or one
+// from the gallery. It's copied first, as setting it moves or removes the
+// file.
+func (f *Flow) setLocalWallpaper(file string) (bool, error) {
+	if f.App.Settings().SafeMode {
+		log.Println("Safe mode is on, not changing wallpaper")
+		return false, nil
+	}
+	tmp, err := os.CreateTemp("", "walltakerbg")
+	if err != nil {
+		return false, err
+	}
+	tmp.Close()
+	err = CopyFile(file, tmp.Name())
+	if err != nil {
+		os.Remove(tmp.Name())
+		return false, err
+	}
+	err = clearWindowsWallpaperCache()
+	if err != nil {
+		log.Println("Could not clear the Windows wallpaper cache: ", err)
+	}
+	return f.setWallpaperFile(tmp.Name(), file)
+}
+
+// RestoreOriginal puts the original wallpaper back right away. Anywhere but
+// on the way out, use QueueRestore.
+func (f *Flow) RestoreOriginal() {
+	bg := ""
+	if f.Hooks.Original != nil {
+		bg = f.Hooks.Original()
+	}
+	if bg == "" {
+		log.Println("No original wallpaper known, can't restore it")
+		return
+	}
+	log.Println("Reverting wallpaper to: ", bg)
+	err := f.Backend.SetFromFile(bg)
+	if err != nil {
+		log.Println("Ouch! Had a problem while restoring your original wallpaper.")
+		log.Println("Full error: ", err)
+	}
+}
+
+// SetMode crops or fits the wallpaper to the screen
+func (f *Flow) SetMode(crop bool) {
+	mode := backend.Fit
+	if crop {
+		mode = backend.Crop
+	}
+	err := f.Backend.SetMode(mode)
+	if err != nil {
+		log.Println("Could not set wallpaper mode to ", mode, ": ", err)
+	}
+}
+
+// clearWindowsWallpaperCache removes the copies Windows keeps of the
+// wallpaper, which it may show instead of a new one
+func clearWindowsWallpaperCache() error {
+	// Remove cached wallpaper files, issue #12
+	if runtime.GOOS != "windows" {
+		return nil
+	}
+	windowsWallpaperCacheDir := os.Getenv("APPDATA") + "\\Microsoft\\Windows\\Themes"
+	err := os.Remove(windowsWallpaperCacheDir + "\\TranscodedWallpaper")
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.RemoveAll(windowsWallpaperCacheDir + "\\CachedFiles")
+}
@@ -0,0 +1,264 @@
+package flow
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"walltaker/backend"
+	"walltaker/fakeserver"
+
+	"github.com/PawCorp/walltaker-desktop-client/walltaker"
+	"github.com/guregu/null"
+)
+
+// testFlow is a flow against a fake Walltaker, setting wallpapers on a
+// Recorder, watching link 123
+type testFlow struct {
+	*Flow
+	server   *fakeserver.Server
+	recorder *backend.Recorder
+	// downloaded gets the content of every downloaded image
+	downloaded chan string
+	recorded   chan walltaker.Link
+}
+
+func newTestFlow(t *testing.T) *testFlow {
+	t.Helper()
+	server := fakeserver.New()
+	t.Cleanup(server.Close)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	client := walltaker.NewClient("walltaker-test")
+	client.BaseURL = server.URL
+	recorder := backend.NewRecorder("/original.png")
+	recorder.Changed = make(chan string, 10)
+	app := NewApp(Settings{Crop: true})
+	app.SetFeed(123)
+
+	tf := &testFlow{
+		Flow:       New(ctx, client, recorder, app),
+		server:     server,
+		recorder:   recorder,
+		downloaded: make(chan string, 10),
+		recorded:   make(chan walltaker.Link, 10),
+	}
+	tf.Hooks = Hooks{
+		Downloaded: func(file string, url string, postURL string) {
+			data, _ := os.ReadFile(file)
+			tf.downloaded <- string(data)
+		},
+		Record: func(post walltaker.Link) {
+			tf.recorded <- post
+		},
+		Original: func() string {
+			return "/original.png"
+		},
+	}
+	return tf
+}
+
+// setPost points link 123 at a new image with data
+func (tf *testFlow) setPost(name string, data string, setBy string) string {
+	postURL := tf.server.AddImage(name, []byte(data))
+	tf.server.SetLink(walltaker.Link{ID: 123, PostURL: null.StringFrom(postURL), SetBy: null.StringFrom(setBy)})
+	return postURL
+}
+
+func (tf *testFlow) waitForWallpaper(t *testing.T) string {
+	t.Helper()
+	select {
+	case file := <-tf.recorder.Changed:
+		return file
+	case <-time.After(5 * time.Second):
+		t.Fatal("wallpaper wasn't set")
+		return ""
+	}
+}
+
+func (tf *testFlow) waitForDownload(t *testing.T, want string) {
+	t.Helper()
+	select {
+	case got := <-tf.downloaded:
+		if got != want {
+			t.Errorf("downloaded %q, want %q", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing downloaded")
+	}
+}
+
+func TestLinkUpdateSetsWallpaper(t *testing.T) {
+	tf := newTestFlow(t)
+	first := tf.setPost("first.png", "first", "gray")
+
+	err := tf.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tf.Watch(123)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tf.Follow()
+	tf.waitForDownload(t, "first")
+	tf.waitForWallpaper(t)
+	if got := tf.App.CurrentPost().PostURL.String; got != first {
+		t.Errorf("current post is %q, want %q", got, first)
+	}
+
+	if !tf.server.WaitForSubscriber(123, 5*time.Second) {
+		t.Fatal("flow never subscribed to the link")
+	}
+	second := tf.setPost("second.png", "second", "someone")
+	tf.waitForDownload(t, "second")
+	tf.waitForWallpaper(t)
+
+	if files := tf.recorder.Files(); len(files) != 2 {
+		t.Errorf("set %d wallpapers, want 2: %v", len(files), files)
+	}
+	if got := tf.App.CurrentPost(); got.PostURL.String != second || got.SetBy.String != "someone" {
+		t.Errorf("current post is %+v, want %s by someone", got, second)
+	}
+	for _, want := range []string{first, second} {
+		if got := <-tf.recorded; got.PostURL.String != want {
+			t.Errorf("recorded %s, want %s", got.PostURL.String, want)
+		}
+	}
+	if mode := tf.recorder.Mode(); mode != backend.Crop {
+		t.Errorf("mode is %s, want crop", mode)
+	}
+}
+
+// Starting while Walltaker is down mustn't hang, it goes offline instead
+func TestStartsOfflineWhenUnreachable(t *testing.T) {
+	tf := newTestFlow(t)
+	tf.server.Close()
+	offline := make(chan struct{}, 10)
+	tf.Hooks.Offline = func() {
+		offline <- struct{}{}
+	}
+
+	started := make(chan error, 1)
+	go func() {
+		err := tf.Connect()
+		if err == nil {
+			err = tf.Watch(123)
+		}
+		tf.Follow()
+		started <- err
+	}()
+	select {
+	case err := <-started:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("starting waited for Walltaker")
+	}
+	select {
+	case <-offline:
+	case <-time.After(5 * time.Second):
+		t.Fatal("never went offline")
+	}
+	if tf.App.Connected() {
+		t.Error("connected to a closed server")
+	}
+	if files := tf.recorder.Files(); len(files) != 0 {
+		t.Errorf("set %v while offline", files)
+	}
+}
+
+// Quitting stops a connection that Walltaker never answers
+func TestShutdownStopsConnecting(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	// accept, then never answer the websocket handshake
+	hungUp := make(chan struct{})
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(io.Discard, conn)
+		close(hungUp)
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := walltaker.NewClient("walltaker-test")
+	client.BaseURL = "http://" + listener.Addr().String()
+	f := New(ctx, client, backend.NewRecorder(""), NewApp(Settings{}))
+	err = f.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	select {
+	case <-hungUp:
+	case <-time.After(time.Second):
+		t.Fatal("the connection outlived the flow")
+	}
+}
+
+func TestAppliedPostIsSkipped(t *testing.T) {
+	tf := newTestFlow(t)
+	post := tf.setPost("first.png", "first", "gray")
+	tf.Hooks.Applied = func(userData walltaker.Link) bool {
+		return userData.PostURL.String == post
+	}
+
+	tf.Received(walltaker.Link{ID: 123, PostURL: null.StringFrom(post), SetBy: null.StringFrom("gray")})
+	tf.Queue.Wait()
+	if files := tf.recorder.Files(); len(files) != 0 {
+		t.Errorf("set %v, the post was already applied", files)
+	}
+}
+
+func TestSafeModeHoldsBackPosts(t *testing.T) {
+	tf := newTestFlow(t)
+	tf.App.UpdateSettings(func(settings *Settings) {
+		settings.SafeMode = true
+	})
+	post := tf.setPost("first.png", "first", "gray")
+
+	tf.Received(walltaker.Link{ID: 123, PostURL: null.StringFrom(post)})
+	waitForState(t, tf.Queue, func(state QueueState) bool { return state.Applied == 1 })
+	if files := tf.recorder.Files(); len(files) != 0 {
+		t.Errorf("set %v in safe mode", files)
+	}
+	select {
+	case got := <-tf.recorded:
+		t.Errorf("recorded %s in safe mode", got.PostURL.String)
+	default:
+	}
+}
+
+func TestQueueRestore(t *testing.T) {
+	tf := newTestFlow(t)
+
+	tf.QueueRestore()
+	if file := tf.waitForWallpaper(t); file != "/original.png" {
+		t.Errorf("restored %q, want /original.png", file)
+	}
+}
+
+// waitForState waits until the queue's state is what done wants
+func waitForState(t *testing.T, q *Queue, done func(state QueueState) bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !done(q.State()) {
+		if time.Now().After(deadline) {
+			t.Fatalf("queue state is %+v", q.State())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
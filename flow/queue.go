@@ -0,0 +1,152 @@
+package flow
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"github.com/PawCorp/walltaker-desktop-client/walltaker"
+)
+
+// Update is one request to put a post on screen
+type Update struct {
+	Post        walltaker.Link
+	SetAt       string
+	SaveLocally bool
+	Notify      bool
+	// Record marks the post as applied once it's up, so it isn't notified
+	// about or saved again after a restart
+	Record bool
+	// File is a local image to put up instead of downloading the post, like
+	// the offline copy of it or a gallery image
+	File string
+	// Restore puts the original wallpaper back instead of a post
+	Restore bool
+}
+
+// target is what the update puts on screen, for logs and telling updates
+// apart
+func (u Update) target() string {
+	if u.Restore {
+		return "the original wallpaper"
+	}
+	if u.Post.PostURL.String == "" {
+		return u.File
+	}
+	return u.Post.PostURL.String
+}
+
+// QueueState is a snapshot of the update queue, for the dashboard and tests
+type QueueState struct {
+	InFlight  string `json:"in_flight"`
+	Pending   string `json:"pending"`
+	Applied   int    `json:"applied"`
+	Coalesced int    `json:"coalesced"`
+	Cancelled int    `json:"cancelled"`
+}
+
+// Queue applies wallpaper updates one at a time. Only the newest update
+// matters: a burst of posts collapses into the last one, and a newer post
+// cancels the download of the one in flight.
+type Queue struct {
+	mu sync.Mutex
+	// ctx stops the queue: nothing is applied after it's cancelled
+	ctx      context.Context
+	apply    func(ctx context.Context, update Update) error
+	pending  *Update
+	inFlight *Update
+	cancel   context.CancelFunc
+	wake     chan struct{}
+	idle     *sync.Cond
+	state    QueueState
+}
+
+// NewQueue starts a queue that runs apply for every update until ctx is done
+func NewQueue(ctx context.Context, apply func(ctx context.Context, update Update) error) *Queue {
+	q := &Queue{
+		ctx:   ctx,
+		apply: apply,
+		wake:  make(chan struct{}, 1),
+	}
+	q.idle = sync.NewCond(&q.mu)
+	go q.run()
+	return q
+}
+
+// Enqueue schedules update, replacing any update still waiting
+func (q *Queue) Enqueue(update Update) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.pending != nil {
+		log.Println("Skipping ", q.pending.target(), ", a newer update came in")
+		q.state.Coalesced++
+	}
+	q.pending = &update
+	q.state.Pending = update.target()
+	if q.inFlight != nil && q.inFlight.target() != update.target() {
+		q.cancel()
+	}
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// State returns what the queue is doing right now
+func (q *Queue) State() QueueState {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.state
+}
+
+// Wait blocks until nothing is pending or in flight
+func (q *Queue) Wait() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.pending != nil || q.inFlight != nil {
+		q.idle.Wait()
+	}
+}
+
+func (q *Queue) run() {
+	for range q.wake {
+		for {
+			q.mu.Lock()
+			update := q.pending
+			if update != nil && q.ctx.Err() != nil {
+				q.pending, q.state.Pending = nil, ""
+				update = nil
+			}
+			if update == nil {
+				q.idle.Broadcast()
+				q.mu.Unlock()
+				break
+			}
+			ctx, cancel := context.WithCancel(q.ctx)
+			q.pending, q.inFlight, q.cancel = nil, update, cancel
+			q.state.Pending, q.state.InFlight = "", update.target()
+			q.mu.Unlock()
+
+			err := q.apply(ctx, *update)
+
+			q.mu.Lock()
+			if q.ctx.Err() != nil {
+				log.Println("Stopped applying ", update.target(), ", shutting down")
+			} else if ctx.Err() != nil {
+				log.Println("Cancelled ", update.target(), ", a newer update came in")
+				q.state.Cancelled++
+			} else if err != nil {
+				log.Println("Could not set wallpaper: ", err)
+			} else {
+				log.Println("Set wallpaper to ", update.target())
+				q.state.Applied++
+			}
+			cancel()
+			q.inFlight, q.cancel = nil, nil
+			q.state.InFlight = ""
+			q.mu.Unlock()
+		}
+	}
+}
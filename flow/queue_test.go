@@ -0,0 +1,180 @@
+package flow
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeApply stands in for setting wallpapers. Updates to block wait in
+// apply until released.
+type fakeApply struct {
+	mu      sync.Mutex
+	applied []string
+	started chan string
+	block   map[string]chan struct{}
+	// honourCancel returns as soon as the update is cancelled, like a
+	// download does
+	honourCancel bool
+}
+
+func newFakeApply(block ...string) *fakeApply {
+	f := &fakeApply{started: make(chan string, 10), block: map[string]chan struct{}{}}
+	for _, target := range block {
+		f.block[target] = make(chan struct{})
+	}
+	return f
+}
+
+func (f *fakeApply) apply(ctx context.Context, update Update) error {
+	f.started <- update.target()
+	if release, ok := f.block[update.target()]; ok {
+		if f.honourCancel {
+			select {
+			case <-release:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		} else {
+			<-release
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	f.mu.Lock()
+	f.applied = append(f.applied, update.target())
+	f.mu.Unlock()
+	return nil
+}
+
+func (f *fakeApply) waitStarted(t *testing.T, want string) {
+	t.Helper()
+	select {
+	case got := <-f.started:
+		if got != want {
+			t.Fatalf("started %s, want %s", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s never started", want)
+	}
+}
+
+func (f *fakeApply) appliedTargets() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return fmt.Sprint(f.applied)
+}
+
+// waitIdle waits for the queue to drain, or fails
+func waitIdle(t *testing.T, q *Queue) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		q.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("queue never drained: %+v", q.State())
+	}
+}
+
+func TestQueueCoalescesBursts(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	apply := newFakeApply("a")
+	q := NewQueue(ctx, apply.apply)
+
+	q.Enqueue(Update{File: "a"})
+	apply.waitStarted(t, "a")
+	for _, target := range []string{"b", "c", "d"} {
+		q.Enqueue(Update{File: target})
+	}
+	if state := q.State(); state.InFlight != "a" || state.Pending != "d" || state.Coalesced != 2 {
+		t.Errorf("got state %+v while a is in flight", state)
+	}
+	close(apply.block["a"])
+	waitIdle(t, q)
+
+	// a was cancelled by b, which with c gave way to d
+	apply.waitStarted(t, "d")
+	if got := apply.appliedTargets(); got != "[d]" {
+		t.Errorf("applied %s, want [d]", got)
+	}
+	state := q.State()
+	if state.Applied != 1 || state.Coalesced != 2 || state.Cancelled != 1 || state.InFlight != "" || state.Pending != "" {
+		t.Errorf("got state %+v", state)
+	}
+}
+
+func TestQueueCancelsInFlight(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	apply := newFakeApply("a")
+	apply.honourCancel = true
+	q := NewQueue(ctx, apply.apply)
+
+	q.Enqueue(Update{File: "a"})
+	apply.waitStarted(t, "a")
+	q.Enqueue(Update{File: "b"})
+	apply.waitStarted(t, "b")
+	waitIdle(t, q)
+
+	if got := apply.appliedTargets(); got != "[b]" {
+		t.Errorf("applied %s, want [b]", got)
+	}
+	if state := q.State(); state.Applied != 1 || state.Cancelled != 1 || state.Coalesced != 0 {
+		t.Errorf("got state %+v", state)
+	}
+}
+
+func TestQueueKeepsSameTargetInFlight(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	apply := newFakeApply("a")
+	apply.honourCancel = true
+	q := NewQueue(ctx, apply.apply)
+
+	q.Enqueue(Update{File: "a"})
+	apply.waitStarted(t, "a")
+	q.Enqueue(Update{File: "a"})
+	close(apply.block["a"])
+	apply.waitStarted(t, "a")
+	waitIdle(t, q)
+
+	if state := q.State(); state.Cancelled != 0 || state.Applied != 2 {
+		t.Errorf("got state %+v, the same post shouldn't cancel itself", state)
+	}
+}
+
+func TestQueueDrainsOnShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	apply := newFakeApply("a")
+	q := NewQueue(ctx, apply.apply)
+
+	q.Enqueue(Update{File: "a"})
+	apply.waitStarted(t, "a")
+	q.Enqueue(Update{File: "b"})
+	cancel()
+	close(apply.block["a"])
+	waitIdle(t, q)
+
+	// nothing is applied once shutting down, not even what was waiting
+	q.Enqueue(Update{File: "c"})
+	waitIdle(t, q)
+	select {
+	case target := <-apply.started:
+		t.Errorf("started %s after shutdown", target)
+	default:
+	}
+	if got := apply.appliedTargets(); got != "[]" {
+		t.Errorf("applied %s after shutdown", got)
+	}
+	if state := q.State(); state.Applied != 0 || state.InFlight != "" || state.Pending != "" {
+		t.Errorf("got state %+v", state)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"walltaker/e621"
+
+	"github.com/juju/fslock"
+)
+
+// Gallery is the index of every wallpaper saved locally. It's a small JSON
+// file in the cache dir, which is plenty for a few thousand images and keeps
+// the client free of cgo databases.
+type Gallery struct {
+	NextID  int            `json:"next_id"`
+	Entries []GalleryEntry `json:"entries"`
+}
+
+type GalleryEntry struct {
+	ID      int       `json:"id"`
+	File    string    `json:"file"`
+	MD5     string    `json:"md5"`
+	LinkID  int       `json:"link_id"`
+	SetBy   string    `json:"set_by"`
+	SavedAt time.Time `json:"saved_at"`
+	PostID  int       `json:"post_id"`
+	Rating  string    `json:"rating"`
+	Artists []string  `json:"artists"`
+	Tags    []string  `json:"tags"`
+	PHash   string    `json:"phash,omitempty"`
+	// Sets is every time this image was sent, starting with the one that
+	// saved it
+	Sets []WallpaperSet `json:"sets"`
+}
+
+// GalleryQuery filters gallery entries; zero values match everything
+type GalleryQuery struct {
+	SetBy  string
+	Tag    string
+	Artist string
+	LinkID int
+	Since  time.Time
+	Until  time.Time
+}
+
+var galleryMu sync.Mutex
+
+// galleryLockTimeout bounds waiting for another Walltaker process to finish
+// with the gallery
+const galleryLockTimeout = 10 * time.Second
+
+func galleryFilePath() (string, error) {
+	dir, err := walltakerDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "gallery.json"), nil
+}
+
+func loadGallery() (Gallery, error) {
+	gallery := Gallery{NextID: 1}
+	galleryPath, err := galleryFilePath()
+	if err != nil {
+		return gallery, err
+	}
+	dat, err := os.ReadFile(galleryPath)
+	if os.IsNotExist(err) {
+		return gallery, nil
+	} else if err != nil {
+		return gallery, err
+	}
+	err = json.Unmarshal(dat, &gallery)
+	return gallery, err
+}
+
+// updateGallery reloads the index from disk, lets update change it and writes
+// it back. It holds a lock file next to the index meanwhile, so the tray app
+// and CLI commands don't overwrite each other.
+func updateGallery(update func(gallery *Gallery)) error {
+	galleryMu.Lock()
+	defer galleryMu.Unlock()
+
+	galleryPath, err := galleryFilePath()
+	if err != nil {
+		return err
+	}
+	lock := fslock.New(galleryPath + ".lock")
+	err = lock.LockWithTimeout(galleryLockTimeout)
+	if err != nil {
+		return fmt.Errorf("gallery is busy: %w", err)
+	}
+	defer lock.Unlock()
+
+	gallery, err := loadGallery()
+	if err != nil {
+		return err
+	}
+	update(&gallery)
+
+	dat, err := json.MarshalIndent(gallery, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(galleryPath, dat)
+}
+
+func (g *Gallery) add(entry GalleryEntry) GalleryEntry {
+	if g.NextID < 1 {
+		g.NextID = 1
+	}
+	entry.ID = g.NextID
+	g.NextID++
+	g.Entries = append(g.Entries, entry)
+	return entry
+}
+
+func (g *Gallery) find(id int) (GalleryEntry, bool) {
+	for _, entry := range g.Entries {
+		if entry.ID == id {
+			return entry, true
+		}
+	}
+	return GalleryEntry{}, false
+}
+
+// search returns the matching entries, oldest first
+func (g *Gallery) search(query GalleryQuery) []GalleryEntry {
+	results := []GalleryEntry{}
+	for _, entry := range g.Entries {
+		if query.SetBy != "" && !entry.wasSetBy(query.SetBy) {
+			continue
+		}
+		if query.LinkID != 0 && entry.LinkID != query.LinkID {
+			continue
+		}
+		if query.Tag != "" && !containsFold(entry.Tags, query.Tag) {
+			continue
+		}
+		if query.Artist != "" && !containsFold(entry.Artists, query.Artist) {
+			continue
+		}
+		if !query.Since.IsZero() && entry.SavedAt.Before(query.Since) {
+			continue
+		}
+		if !query.Until.IsZero() && !entry.SavedAt.Before(query.Until) {
+			continue
+		}
+		results = append(results, entry)
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].SavedAt.Before(results[j].SavedAt)
+	})
+	return results
+}
+
+func (e GalleryEntry) wasSetBy(setBy string) bool {
+	if strings.EqualFold(e.SetBy, setBy) {
+		return true
+	}
+	for _, set := range e.Sets {
+		if strings.EqualFold(set.SetBy, setBy) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// newGalleryEntry builds an index entry from a saved file's metadata
+func newGalleryEntry(filename string, md5 string, metadata WallpaperMetadata, savedAt time.Time) GalleryEntry {
+	entry := GalleryEntry{
+		File:    filename,
+		MD5:     md5,
+		LinkID:  metadata.LinkID,
+		SetBy:   metadata.SetBy,
+		SavedAt: savedAt,
+		Artists: []string{},
+		Tags:    []string{},
+		Sets: []WallpaperSet{{
+			SetBy:  metadata.SetBy,
+			LinkID: metadata.LinkID,
+			SetAt:  savedAt,
+		}},
+	}
+	if post := metadata.E621Post; post != nil {
+		entry.PostID = post.ID
+		entry.Rating = post.Rating
+		entry.Artists = postArtists(post)
+		entry.Tags = postTags(post)
+	}
+	return entry
+}
+
+// postTags flattens all tag categories of a post
+func postTags(post *e621.Post) []string {
+	tags := []string{}
+	for _, category := range [][]string{
+		post.Tags.General,
+		post.Tags.Species,
+		post.Tags.Character,
+		post.Tags.Copyright,
+		post.Tags.Artist,
+		post.Tags.Meta,
+	} {
+		tags = append(tags, category...)
+	}
+	return tags
+}
+
+func addToGallery(entry GalleryEntry) error {
+	return updateGallery(func(gallery *Gallery) {
+		gallery.add(entry)
+	})
+}
@@ -3,7 +3,10 @@ module walltaker
 go 1.18
 
 require (
+	github.com/PawCorp/walltaker-desktop-client/walltaker v0.0.0-00010101000000-000000000000
 	github.com/getlantern/systray v1.2.1
+	github.com/godbus/dbus/v5 v5.1.0
+	github.com/gorilla/websocket v1.5.0
 	github.com/guregu/null v4.0.0+incompatible
 	github.com/hugolgst/rich-go v0.0.0-20210925091458-d59fb695d9c0
 	github.com/juju/fslock v0.0.0-20160525022230-4d5c94c67b4b
@@ -12,10 +15,13 @@ require (
 	github.com/pelletier/go-toml v1.9.4
 	github.com/pkg/browser v0.0.0-20210911075715-681adbf594b8
 	github.com/reujab/wallpaper v0.0.0-20210630195606-5f9f655b3740
+	github.com/zalando/go-keyring v0.2.1
 )
 
 require (
+	github.com/alessio/shellescape v1.4.1 // indirect
 	github.com/bhendo/go-powershell v0.0.0-20190719160123-219e7fb4e41e // indirect
+	github.com/danieljoos/wincred v1.1.0 // indirect
 	github.com/fsnotify/fsnotify v1.4.9 // indirect
 	github.com/getlantern/context v0.0.0-20190109183933-c447772a6520 // indirect
 	github.com/getlantern/errors v1.0.1 // indirect
@@ -25,18 +31,14 @@ require (
 	github.com/getlantern/ops v0.0.0-20200403153110-8476b16edcd6 // indirect
 	github.com/go-stack/stack v1.8.1 // indirect
 	github.com/go-toast/toast v0.0.0-20190211030409-01e6764cf0a4 // indirect
-	github.com/godbus/dbus/v5 v5.1.0 // indirect
 	github.com/gopherjs/gopherjs v0.0.0-20220221023154-0b2280d3ff96 // indirect
 	github.com/gopherjs/gopherwasm v1.1.0 // indirect
-	github.com/gorilla/websocket v1.5.0 // indirect
 	github.com/inconshreveable/mousetrap v1.0.0 // indirect
-	github.com/jpillora/backoff v1.0.0 // indirect
 	github.com/juju/errors v0.0.0-20220324005906-d8c5072c94ab // indirect
 	github.com/neelance/astrewrite v0.0.0-20160511093645-99348263ae86 // indirect
 	github.com/neelance/sourcemap v0.0.0-20200213170602-2833bce08e4c // indirect
 	github.com/nu7hatch/gouuid v0.0.0-20131221200532-179d4d0c4d8d // indirect
 	github.com/oxtoacart/bpool v0.0.0-20190530202638-03653db5a59c // indirect
-	github.com/potato2003/actioncable-client-go v0.0.0-20200530121345-f064d751d145 // indirect
 	github.com/shurcooL/httpfs v0.0.0-20190707220628-8d4bc4ba7749 // indirect
 	github.com/sirupsen/logrus v1.8.1 // indirect
 	github.com/spf13/cobra v1.2.1 // indirect
@@ -55,6 +57,9 @@ require (
 	github.com/gen2brain/beeep v0.0.0-20220322123227-629384b5779c
 	golang.org/x/sys v0.0.0-20220319134239-a9b59b0215f8 // indirect
 	gopkg.in/ini.v1 v1.66.4 // indirect
-	gopkg.in/natefinch/npipe.v2 v2.0.0-20160621034901-c1b8fa8bdcce // indirect
+	gopkg.in/natefinch/npipe.v2 v2.0.0-20160621034901-c1b8fa8bdcce
 	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
+
+// the walltaker package is its own module so other tools can use it
+replace github.com/PawCorp/walltaker-desktop-client/walltaker => ./walltaker
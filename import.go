@@ -0,0 +1,164 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"walltaker/e621"
+)
+
+// legacySaveFilename matches files saved by older versions as
+// walltaker_<setter>_<time>_<md5>.<ext>, where <time> is RFC3339 with the
+// colons replaced by dashes. Setter names may contain underscores themselves.
+var legacySaveFilename = regexp.MustCompile(`^walltaker_(.*)_(\d{4}-\d{2}-\d{2}T\d{2}-\d{2}-\d{2}(?:Z|[+-]\d{2}-\d{2}))_([0-9a-fA-F]{32})\.(\w+)$`)
+
+type legacySave struct {
+	SetBy string
+	SetAt string
+	Time  time.Time
+	MD5   string
+	Ext   string
+}
+
+// parseLegacySaveFilename is the inverse of the naming saveWallpaperLocally
+// used before filenames were configurable
+func parseLegacySaveFilename(name string) (legacySave, bool) {
+	match := legacySaveFilename.FindStringSubmatch(name)
+	if match == nil {
+		return legacySave{}, false
+	}
+	save := legacySave{
+		SetBy: match[1],
+		SetAt: match[2],
+		MD5:   strings.ToLower(match[3]),
+		Ext:   match[4],
+	}
+
+	// 2022-09-13T10-00-00+02-00 -> 2022-09-13T10:00:00+02:00
+	date, clock := save.SetAt[:11], save.SetAt[11:]
+	clock = strings.Replace(clock, "-", ":", 2)
+	if len(clock) > 8 && clock[8] != 'Z' {
+		clock = clock[:11] + ":" + clock[12:]
+	}
+	t, err := time.Parse(time.RFC3339, date+clock)
+	if err != nil {
+		return legacySave{}, false
+	}
+	save.Time = t
+	return save, true
+}
+
+func galleryImportCommand(args []string) {
+	flags := flag.NewFlagSet("gallery import", flag.ExitOnError)
+	link := flags.Int("link", 0, "link ID the imported wallpapers were sent to, if known")
+	flags.Parse(args)
+
+	// lookups go through the configured e621 client: base, login, contact
+	// and cache
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Println("Could not read walltaker.toml, using defaults:", err)
+	} else {
+		configureClients(cfg)
+		saveDirectory = cfg.SaveDirectory
+	}
+
+	dir := flags.Arg(0)
+	if dir == "" {
+		dir, err = resolveSaveDirectory()
+		if err != nil {
+			fmt.Println("Could not find download folder:", err)
+			os.Exit(1)
+		}
+	}
+
+	// the gallery keeps absolute paths, so importing the same folder by
+	// another name finds what's already there, and apply and open work from
+	// anywhere
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		fmt.Println("Could not find", dir+":", err)
+		os.Exit(1)
+	}
+	dir = abs
+
+	gallery, err := loadGallery()
+	if err != nil {
+		fmt.Println("Could not read gallery:", err)
+		os.Exit(1)
+	}
+	known := map[string]bool{}
+	for _, entry := range gallery.Entries {
+		known[filepath.Clean(entry.File)] = true
+	}
+
+	fmt.Println("Importing wallpapers from", dir)
+	imported, skipped := 0, 0
+	err = filepath.WalkDir(dir, func(filename string, d fs.DirEntry, err error) error {
+		if err != nil && filename != dir {
+			// one unreadable folder shouldn't stop the rest
+			fmt.Println("Skipping", filename+":", err)
+			if d != nil && d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if err != nil || d.IsDir() {
+			return err
+		}
+		save, ok := parseLegacySaveFilename(d.Name())
+		if !ok {
+			return nil
+		}
+		if known[filename] {
+			skipped++
+			return nil
+		}
+
+		var post *e621.Post
+		postsData, err := getE621DataByMD5(save.MD5)
+		if err != nil {
+			fmt.Println("Could not look up", d.Name(), "on e621:", err)
+		} else if len(postsData.Posts) > 0 {
+			post = &postsData.Posts[0]
+		}
+
+		metadata := WallpaperMetadata{
+			LinkID:   *link,
+			SetBy:    save.SetBy,
+			SetAt:    save.SetAt,
+			File:     d.Name(),
+			E621Post: post,
+			Sets: []WallpaperSet{{
+				SetBy:  save.SetBy,
+				LinkID: *link,
+				SetAt:  save.Time,
+			}},
+		}
+		if _, err := os.Stat(sidecarPath(filename)); os.IsNotExist(err) {
+			err = writeSidecar(filename, metadata)
+			if err != nil {
+				fmt.Println("Could not write metadata for", d.Name()+":", err)
+			}
+		}
+		err = addToGallery(newGalleryEntry(filename, save.MD5, metadata, save.Time))
+		if err != nil {
+			return err
+		}
+		known[filename] = true
+		imported++
+		fmt.Println("Imported", d.Name())
+		return nil
+	})
+	if err != nil {
+		fmt.Println("Import failed:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Imported %d wallpapers, %d were already in the gallery\n", imported, skipped)
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gen2brain/beeep"
+	"github.com/pelletier/go-toml"
+)
+
+// Notification is something worth telling the user about, on the desktop or
+// on their other devices
+type Notification struct {
+	// Event is "wallpaper" for a new wallpaper, "update" for a new version,
+	// "action" for how something the user did went (setting a wallpaper,
+	// responding), "expiry" as the link runs out, "blacklist" for a post
+	// with blacklisted tags or "error" when Walltaker can't run
+	Event    string
+	Title    string
+	Body     string
+	Image    string // local file, for the desktop
+	ImageURL string // remote URL, for everything else
+	PostURL  string
+	SetBy    string
+	LinkID   int
+	Actions  notificationActions
+}
+
+// Notifier delivers notifications to one place
+type Notifier interface {
+	Name() string
+	Notify(n Notification) error
+}
+
+// notifierFilter limits which notifications a notifier gets; empty lists let
+// everything through
+type notifierFilter struct {
+	Events  []string
+	Setters []string
+}
+
+func (f notifierFilter) allows(n Notification) bool {
+	if len(f.Events) > 0 && !containsFold(f.Events, n.Event) {
+		return false
+	}
+	if len(f.Setters) > 0 && n.Event == "wallpaper" && !containsFold(f.Setters, n.SetBy) {
+		return false
+	}
+	return true
+}
+
+type filteredNotifier struct {
+	Notifier
+	filter notifierFilter
+}
+
+// the desktop is always there, even before the config is loaded
+var notifiers = []filteredNotifier{{Notifier: desktopNotifier{}}}
+var notifiersMu sync.Mutex
+
+var notifierClient = &http.Client{
+	Timeout: time.Second * 10,
+}
+
+// sendNotification hands n to every notifier that wants it. The desktop is
+// notified right away, remote notifiers in the background so a slow server
+// doesn't hold up the wallpaper. Nothing is sent in safe mode.
+func sendNotification(n Notification) {
+	if app.Settings().SafeMode {
+		log.Println("Safe mode is on, not sending notification: ", n.Title)
+		return
+	}
+	notifiersMu.Lock()
+	targets := append([]filteredNotifier{}, notifiers...)
+	notifiersMu.Unlock()
+
+	for _, target := range targets {
+		if !target.filter.allows(n) {
+			continue
+		}
+		notifier := target.Notifier
+		if _, ok := notifier.(desktopNotifier); ok {
+			err := notifier.Notify(n)
+			if err != nil {
+				log.Println("Could not show notification: ", err)
+			}
+			continue
+		}
+		go func() {
+			err := notifier.Notify(n)
+			if err != nil {
+				log.Println("Could not send notification to ", notifier.Name(), ": ", err)
+			}
+		}()
+	}
+}
+
+// loadNotifiers sets up the notifiers from the [Notify.*] sections of the config
+func loadNotifiers(config *toml.Tree) {
+	loaded := []filteredNotifier{{
+		Notifier: desktopNotifier{},
+		filter:   loadNotifierFilter(config, "desktop"),
+	}}
+
+	if notifierEnabled(config, "webhook") {
+		loaded = append(loaded, filteredNotifier{
+			Notifier: webhookNotifier{
+				URL:      configString(config, "Notify.webhook.url", ""),
+				Template: configString(config, "Notify.webhook.template", defaultWebhookTemplate),
+			},
+			filter: loadNotifierFilter(config, "webhook"),
+		})
+	}
+	if notifierEnabled(config, "discord") {
+		loaded = append(loaded, filteredNotifier{
+			Notifier: discordWebhookNotifier{
+				URL: configString(config, "Notify.discord.url", ""),
+			},
+			filter: loadNotifierFilter(config, "discord"),
+		})
+	}
+	if notifierEnabled(config, "matrix") {
+		loaded = append(loaded, filteredNotifier{
+			Notifier: matrixNotifier{
+				Homeserver:  configString(config, "Notify.matrix.homeserver", ""),
+				RoomID:      configString(config, "Notify.matrix.room", ""),
+				AccessToken: configString(config, "Notify.matrix.token", ""),
+			},
+			filter: loadNotifierFilter(config, "matrix"),
+		})
+	}
+	if notifierEnabled(config, "ntfy") {
+		loaded = append(loaded, filteredNotifier{
+			Notifier: ntfyNotifier{
+				URL:   configString(config, "Notify.ntfy.url", ""),
+				Token: configString(config, "Notify.ntfy.token", ""),
+			},
+			filter: loadNotifierFilter(config, "ntfy"),
+		})
+	}
+	if notifierEnabled(config, "gotify") {
+		loaded = append(loaded, filteredNotifier{
+			Notifier: gotifyNotifier{
+				URL:   configString(config, "Notify.gotify.url", ""),
+				Token: configString(config, "Notify.gotify.token", ""),
+			},
+			filter: loadNotifierFilter(config, "gotify"),
+		})
+	}
+
+	for _, notifier := range loaded[1:] {
+		log.Println("Sending notifications to ", notifier.Name())
+	}
+
+	notifiersMu.Lock()
+	notifiers = loaded
+	notifiersMu.Unlock()
+}
+
+func notifierEnabled(config *toml.Tree, name string) bool {
+	enabled, _ := config.GetDefault("Notify."+name+".enabled", false).(bool)
+	return enabled
+}
+
+func loadNotifierFilter(config *toml.Tree, name string) notifierFilter {
+	filter := notifierFilter{}
+	filter.Events, _ = config.GetArray("Notify." + name + ".events").([]string)
+	filter.Setters, _ = config.GetArray("Notify." + name + ".setters").([]string)
+	return filter
+}
+
+func configString(config *toml.Tree, key string, def string) string {
+	value, ok := config.GetDefault(key, def).(string)
+	if !ok {
+		return def
+	}
+	return value
+}
+
+// postNotification sends req and treats anything but a 2xx as an error
+func postNotification(req *http.Request) error {
+	res, err := notifierClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %s", req.URL.Host, res.Status)
+	}
+	return nil
+}
+
+func postJSON(method string, target string, payload interface{}, header http.Header) error {
+	dat, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, target, bytes.NewReader(dat))
+	if err != nil {
+		return err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgent)
+	return postNotification(req)
+}
+
+// desktopNotifier shows OS notifications. New wallpapers follow the
+// Notifications checkbox in the tray, everything else always shows.
+type desktopNotifier struct{}
+
+func (desktopNotifier) Name() string {
+	return "desktop"
+}
+
+func (desktopNotifier) Notify(n Notification) error {
+	if n.Event != "wallpaper" {
+		return beeep.Notify(n.Title, n.Body, n.Image)
+	}
+	if !app.Settings().Notifications {
+		return nil
+	}
+	return showWallpaperNotification(n.Title, n.Body, n.Image, n.Actions)
+}
+
+const defaultWebhookTemplate = `{"event": "{event}", "title": "{title}", "body": "{body}", "setter": "{setter}", "link": {link}, "post_url": "{post_url}", "image_url": "{image_url}"}`
+
+// webhookNotifier POSTs a JSON body built from Template. Placeholders are
+// JSON escaped, so they belong inside quotes (except {link}, a number).
+type webhookNotifier struct {
+	URL      string
+	Template string
+}
+
+func (w webhookNotifier) Name() string {
+	return "webhook"
+}
+
+func (w webhookNotifier) Notify(n Notification) error {
+	escape := func(s string) string {
+		quoted, _ := json.Marshal(s)
+		return string(quoted[1 : len(quoted)-1])
+	}
+	body := strings.NewReplacer(
+		"{event}", escape(n.Event),
+		"{title}", escape(n.Title),
+		"{body}", escape(n.Body),
+		"{setter}", escape(n.SetBy),
+		"{link}", strconv.Itoa(n.LinkID),
+		"{post_url}", escape(n.PostURL),
+		"{image_url}", escape(n.ImageURL),
+	).Replace(w.Template)
+	if !json.Valid([]byte(body)) {
+		return fmt.Errorf("webhook template does not make valid JSON: %s", body)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, w.URL, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgent)
+	return postNotification(req)
+}
+
+// discordWebhookNotifier posts an embed to a Discord channel webhook
+type discordWebhookNotifier struct {
+	URL string
+}
+
+func (d discordWebhookNotifier) Name() string {
+	return "Discord webhook"
+}
+
+func (d discordWebhookNotifier) Notify(n Notification) error {
+	embed := map[string]interface{}{
+		"title":       n.Title,
+		"description": n.Body,
+	}
+	if n.PostURL != "" {
+		embed["url"] = n.PostURL
+	}
+	if n.ImageURL != "" {
+		embed["thumbnail"] = map[string]string{"url": n.ImageURL}
+	}
+	return postJSON(http.MethodPost, d.URL, map[string]interface{}{
+		"username": "Walltaker",
+		"embeds":   []interface{}{embed},
+	}, nil)
+}
+
+// matrixNotifier sends a text message to a Matrix room
+type matrixNotifier struct {
+	Homeserver  string
+	RoomID      string
+	AccessToken string
+}
+
+func (m matrixNotifier) Name() string {
+	return "Matrix"
+}
+
+func (m matrixNotifier) Notify(n Notification) error {
+	text := n.Title + ": " + n.Body
+	if n.PostURL != "" {
+		text += "\n" + n.PostURL
+	}
+	target := fmt.Sprintf("%s/_matrix/client/v3/rooms/%s/send/m.room.message/walltaker-%d",
+		strings.TrimRight(m.Homeserver, "/"), url.PathEscape(m.RoomID), time.Now().UnixNano())
+	return postJSON(http.MethodPut, target, map[string]string{
+		"msgtype": "m.text",
+		"body":    text,
+	}, http.Header{"Authorization": {"Bearer " + m.AccessToken}})
+}
+
+// ntfyNotifier publishes to an ntfy topic URL, e.g. https://ntfy.sh/mytopic
+type ntfyNotifier struct {
+	URL   string
+	Token string
+}
+
+func (n ntfyNotifier) Name() string {
+	return "ntfy"
+}
+
+func (n ntfyNotifier) Notify(notification Notification) error {
+	req, err := http.NewRequest(http.MethodPost, n.URL, strings.NewReader(notification.Body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Title", notification.Title)
+	req.Header.Set("Tags", "framed_picture")
+	if notification.PostURL != "" {
+		req.Header.Set("Click", notification.PostURL)
+	}
+	if notification.ImageURL != "" {
+		req.Header.Set("Attach", notification.ImageURL)
+	}
+	if n.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+n.Token)
+	}
+	req.Header.Set("User-Agent", userAgent)
+	return postNotification(req)
+}
+
+// gotifyNotifier sends a message to a Gotify server with an app token
+type gotifyNotifier struct {
+	URL   string
+	Token string
+}
+
+func (g gotifyNotifier) Name() string {
+	return "Gotify"
+}
+
+func (g gotifyNotifier) Notify(n Notification) error {
+	message := n.Body
+	if n.PostURL != "" {
+		message += "\n" + n.PostURL
+	}
+	return postJSON(http.MethodPost, strings.TrimRight(g.URL, "/")+"/message", map[string]interface{}{
+		"title":    n.Title,
+		"message":  message,
+		"priority": 5,
+	}, http.Header{"X-Gotify-Key": {g.Token}})
+}
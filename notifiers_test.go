@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"walltaker/flow"
+)
+
+// received is one request a test server got
+type received struct {
+	Method string
+	Path   string
+	Header http.Header
+	Body   string
+}
+
+// notifierServer records every request and answers with status
+func notifierServer(t *testing.T, status int) (*httptest.Server, chan received) {
+	t.Helper()
+	requests := make(chan received, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- received{Method: r.Method, Path: r.URL.Path, Header: r.Header, Body: string(body)}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, requests
+}
+
+func nextRequest(t *testing.T, requests chan received) received {
+	t.Helper()
+	select {
+	case req := <-requests:
+		return req
+	case <-time.After(5 * time.Second):
+		t.Fatal("no request")
+		return received{}
+	}
+}
+
+var testNotification = Notification{
+	Event:    "wallpaper",
+	Title:    "New wallpaper",
+	Body:     `gray set "a post"`,
+	ImageURL: "https://static1.e621.net/data/preview/ab/cd/abcd.jpg",
+	PostURL:  "https://static1.e621.net/data/ab/cd/abcd.png",
+	SetBy:    "gray",
+	LinkID:   123,
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	server, requests := notifierServer(t, http.StatusOK)
+
+	err := webhookNotifier{URL: server.URL, Template: defaultWebhookTemplate}.Notify(testNotification)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := nextRequest(t, requests)
+	if req.Method != http.MethodPost || req.Header.Get("User-Agent") != userAgent {
+		t.Errorf("got %s with User-Agent %q", req.Method, req.Header.Get("User-Agent"))
+	}
+	var payload map[string]interface{}
+	err = json.Unmarshal([]byte(req.Body), &payload)
+	if err != nil {
+		t.Fatalf("body %s: %v", req.Body, err)
+	}
+	if payload["body"] != testNotification.Body || payload["link"] != float64(123) || payload["setter"] != "gray" {
+		t.Errorf("got %v", payload)
+	}
+}
+
+func TestWebhookNotifierInvalidTemplate(t *testing.T) {
+	server, requests := notifierServer(t, http.StatusOK)
+
+	err := webhookNotifier{URL: server.URL, Template: `{"title": {title}}`}.Notify(testNotification)
+	if err == nil {
+		t.Error("expected an error for invalid JSON")
+	}
+	select {
+	case <-requests:
+		t.Error("sent invalid JSON")
+	default:
+	}
+}
+
+func TestDiscordWebhookNotifier(t *testing.T) {
+	server, requests := notifierServer(t, http.StatusNoContent)
+
+	err := discordWebhookNotifier{URL: server.URL}.Notify(testNotification)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := nextRequest(t, requests)
+	var payload struct {
+		Embeds []struct {
+			Title     string `json:"title"`
+			URL       string `json:"url"`
+			Thumbnail struct {
+				URL string `json:"url"`
+			} `json:"thumbnail"`
+		} `json:"embeds"`
+	}
+	err = json.Unmarshal([]byte(req.Body), &payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payload.Embeds) != 1 || payload.Embeds[0].URL != testNotification.PostURL ||
+		payload.Embeds[0].Thumbnail.URL != testNotification.ImageURL {
+		t.Errorf("got %s", req.Body)
+	}
+}
+
+func TestMatrixNotifier(t *testing.T) {
+	server, requests := notifierServer(t, http.StatusOK)
+
+	err := matrixNotifier{Homeserver: server.URL + "/", RoomID: "!room:example.org", AccessToken: "secret"}.Notify(testNotification)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := nextRequest(t, requests)
+	if req.Method != http.MethodPut {
+		t.Errorf("got method %s", req.Method)
+	}
+	if !strings.HasPrefix(req.Path, "/_matrix/client/v3/rooms/!room:example.org/send/m.room.message/walltaker-") {
+		t.Errorf("got path %s", req.Path)
+	}
+	if req.Header.Get("Authorization") != "Bearer secret" {
+		t.Errorf("got Authorization %q", req.Header.Get("Authorization"))
+	}
+	if !strings.Contains(req.Body, "m.text") {
+		t.Errorf("got %s", req.Body)
+	}
+}
+
+func TestNtfyNotifier(t *testing.T) {
+	server, requests := notifierServer(t, http.StatusOK)
+
+	err := ntfyNotifier{URL: server.URL + "/mytopic", Token: "tk"}.Notify(testNotification)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := nextRequest(t, requests)
+	if req.Path != "/mytopic" || req.Body != testNotification.Body {
+		t.Errorf("got %s %q", req.Path, req.Body)
+	}
+	for header, want := range map[string]string{
+		"Title":         testNotification.Title,
+		"Click":         testNotification.PostURL,
+		"Attach":        testNotification.ImageURL,
+		"Authorization": "Bearer tk",
+		"User-Agent":    userAgent,
+	} {
+		if got := req.Header.Get(header); got != want {
+			t.Errorf("%s: got %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestGotifyNotifier(t *testing.T) {
+	server, requests := notifierServer(t, http.StatusOK)
+
+	err := gotifyNotifier{URL: server.URL + "/", Token: "tk"}.Notify(testNotification)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := nextRequest(t, requests)
+	if req.Path != "/message" || req.Header.Get("X-Gotify-Key") != "tk" {
+		t.Errorf("got %s with key %q", req.Path, req.Header.Get("X-Gotify-Key"))
+	}
+	if !strings.Contains(req.Body, testNotification.PostURL) {
+		t.Errorf("got %s", req.Body)
+	}
+}
+
+func TestNotifierErrorStatus(t *testing.T) {
+	server, _ := notifierServer(t, http.StatusInternalServerError)
+
+	err := gotifyNotifier{URL: server.URL, Token: "tk"}.Notify(testNotification)
+	if err == nil || !strings.Contains(err.Error(), "500") {
+		t.Errorf("got %v, want a 500 error", err)
+	}
+}
+
+func TestNotifierFilter(t *testing.T) {
+	filter := notifierFilter{Events: []string{"Wallpaper", "error"}, Setters: []string{"GRAY"}}
+	for _, test := range []struct {
+		n    Notification
+		want bool
+	}{
+		{Notification{Event: "wallpaper", SetBy: "gray"}, true},
+		{Notification{Event: "wallpaper", SetBy: "someone"}, false},
+		{Notification{Event: "error"}, true},
+		{Notification{Event: "expiry"}, false},
+	} {
+		if got := filter.allows(test.n); got != test.want {
+			t.Errorf("%+v: got %v, want %v", test.n, got, test.want)
+		}
+	}
+	if !(notifierFilter{}).allows(Notification{Event: "blacklist"}) {
+		t.Error("an empty filter should allow everything")
+	}
+}
+
+// useNotifiers swaps the loaded notifiers for the test, keeping the desktop
+// out of it
+func useNotifiers(t *testing.T, loaded ...filteredNotifier) {
+	notifiersMu.Lock()
+	was := notifiers
+	notifiers = loaded
+	notifiersMu.Unlock()
+	t.Cleanup(func() {
+		notifiersMu.Lock()
+		notifiers = was
+		notifiersMu.Unlock()
+	})
+}
+
+func TestSendNotification(t *testing.T) {
+	server, requests := notifierServer(t, http.StatusOK)
+	useNotifiers(t,
+		filteredNotifier{Notifier: ntfyNotifier{URL: server.URL + "/all"}},
+		filteredNotifier{Notifier: ntfyNotifier{URL: server.URL + "/errors"}, filter: notifierFilter{Events: []string{"error"}}},
+	)
+
+	sendNotification(testNotification)
+	if req := nextRequest(t, requests); req.Path != "/all" {
+		t.Errorf("got %s, want /all", req.Path)
+	}
+	select {
+	case req := <-requests:
+		t.Errorf("filtered notifier got %s", req.Path)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestSendNotificationSafeMode(t *testing.T) {
+	server, requests := notifierServer(t, http.StatusOK)
+	useNotifiers(t, filteredNotifier{Notifier: ntfyNotifier{URL: server.URL}})
+	app.UpdateSettings(func(settings *flow.Settings) { settings.SafeMode = true })
+	t.Cleanup(func() {
+		app.UpdateSettings(func(settings *flow.Settings) { settings.SafeMode = false })
+	})
+
+	for _, event := range []string{"wallpaper", "action", "expiry", "blacklist", "error"} {
+		n := testNotification
+		n.Event = event
+		sendNotification(n)
+	}
+	select {
+	case req := <-requests:
+		t.Errorf("sent %q in safe mode", req.Body)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
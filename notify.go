@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"walltaker/config"
+	"walltaker/e621"
+
+	"github.com/PawCorp/walltaker-desktop-client/walltaker"
+)
+
+var notificationTitle string = config.DefaultNotificationTitle
+var notificationBody string = config.DefaultNotificationBody
+var notificationThumbnails bool = true
+
+// notificationActions are the buttons offered on a wallpaper notification,
+// where the OS supports them
+type notificationActions struct {
+	OpenSource func()
+	Revert     func()
+	Save       func()
+}
+
+// formatNotification fills in {setter}, {link} and {time}
+func formatNotification(template string, userData walltaker.Link) string {
+	setter := userData.SetBy.String
+	if setter == "" {
+		setter = "Someone"
+	}
+	return strings.NewReplacer(
+		"{setter}", setter,
+		"{link}", strconv.Itoa(userData.ID),
+		"{time}", time.Now().Format("15:04"),
+	).Replace(template)
+}
+
+func notifyNewWallpaper(userData walltaker.Link, setAt string) {
+	n := Notification{
+		Event:   "wallpaper",
+		Title:   formatNotification(notificationTitle, userData),
+		Body:    formatNotification(notificationBody, userData),
+		PostURL: userData.PostURL.String,
+		SetBy:   userData.SetBy.String,
+		LinkID:  userData.ID,
+		Actions: notificationActions{
+			OpenSource: func() {
+				openSourcePage(userData.PostURL.String)
+			},
+			Revert: func() {
+				wallpapers.QueueRestore()
+			},
+			Save: func() {
+				saveWallpaperLocally(userData, setAt)
+			},
+		},
+	}
+
+	if notificationThumbnails {
+		var err error
+		n.ImageURL, err = thumbnailSourceURL(userData)
+		if err == nil && n.ImageURL != "" && app.Settings().Notifications {
+			// only the desktop needs a local copy
+			n.Image, err = cachedThumbnail(n.ImageURL, e621.ExtractMD5(userData.PostURL.String))
+		}
+		if err != nil {
+			log.Println("Could not get thumbnail for notification: ", err)
+		}
+	}
+
+	sendNotification(n)
+}
+
+// thumbnailSourceURL returns Walltaker's thumbnail URL for the post, or else
+// e621's preview
+func thumbnailSourceURL(userData walltaker.Link) (string, error) {
+	if thumbnail := userData.PostThumbnailURL.String; thumbnail != "" {
+		return thumbnail, nil
+	}
+	source := sourceFor(userData.PostURL.String)
+	post, err := source.Lookup(userData.PostURL.String)
+	if err != nil || post == nil {
+		return "", err
+	}
+	return post.Preview.URL, nil
+}
+
+// cachedThumbnail returns a local copy of a thumbnail, downloading it once
+func cachedThumbnail(thumbnailUrl string, name string) (string, error) {
+	dir, err := walltakerDir()
+	if err != nil {
+		return "", err
+	}
+	thumbnailDir := filepath.Join(dir, "thumbnails")
+	err = os.MkdirAll(thumbnailDir, os.FileMode(0777))
+	if err != nil {
+		return "", err
+	}
+	if name == "" {
+		name = e621.ExtractMD5(thumbnailUrl)
+	}
+	filename := filepath.Join(thumbnailDir, sanitizeFilename(name+path.Ext(thumbnailUrl)))
+	if fileExists(filename) {
+		return filename, nil
+	}
+
+	webClient := http.Client{
+		Timeout: time.Second * 5,
+	}
+	res, err := webClient.Get(thumbnailUrl)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return "", fmt.Errorf("thumbnail: %s", res.Status)
+	}
+	dat, err := io.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	return filename, writeFileAtomic(filename, dat)
+}
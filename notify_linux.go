@@ -0,0 +1,112 @@
+package main
+
+import (
+	"log"
+	"sync"
+
+	"github.com/gen2brain/beeep"
+	"github.com/godbus/dbus/v5"
+)
+
+const notificationsDest = "org.freedesktop.Notifications"
+const notificationsPath = "/org/freedesktop/Notifications"
+
+var notificationHandlers = map[uint32]notificationActions{}
+var notificationHandlersMu sync.Mutex
+var notificationListener sync.Once
+
+// showWallpaperNotification talks to the notification daemon over D-Bus, so
+// we can offer buttons when the daemon supports them. Without a session bus we
+// fall back to a plain beeep notification.
+func showWallpaperNotification(title string, body string, icon string, actions notificationActions) error {
+	conn, err := dbus.SessionBus()
+	if err != nil {
+		return beeep.Notify(title, body, icon)
+	}
+	obj := conn.Object(notificationsDest, notificationsPath)
+
+	var capabilities []string
+	err = obj.Call(notificationsDest+".GetCapabilities", 0).Store(&capabilities)
+	if err != nil {
+		return beeep.Notify(title, body, icon)
+	}
+	supportsActions := false
+	for _, capability := range capabilities {
+		if capability == "actions" {
+			supportsActions = true
+		}
+	}
+
+	buttons := []string{}
+	if supportsActions {
+		buttons = []string{
+			"default", "Open Source Page",
+			"open", "Open Source Page",
+			"revert", "Revert",
+			"save", "Save",
+		}
+		notificationListener.Do(func() {
+			go listenForNotificationActions(conn)
+		})
+	}
+	hints := map[string]dbus.Variant{}
+	if icon != "" {
+		hints["image-path"] = dbus.MakeVariant(icon)
+	}
+
+	var id uint32
+	err = obj.Call(notificationsDest+".Notify", 0, "Walltaker", uint32(0), icon, title, body, buttons, hints, int32(-1)).Store(&id)
+	if err != nil {
+		return err
+	}
+	if supportsActions {
+		notificationHandlersMu.Lock()
+		notificationHandlers[id] = actions
+		notificationHandlersMu.Unlock()
+	}
+	return nil
+}
+
+func listenForNotificationActions(conn *dbus.Conn) {
+	err := conn.AddMatchSignal(
+		dbus.WithMatchObjectPath(notificationsPath),
+		dbus.WithMatchInterface(notificationsDest),
+	)
+	if err != nil {
+		log.Println("Could not listen for notification actions: ", err)
+		return
+	}
+	signals := make(chan *dbus.Signal, 10)
+	conn.Signal(signals)
+
+	for signal := range signals {
+		if len(signal.Body) < 2 {
+			continue
+		}
+		id, ok := signal.Body[0].(uint32)
+		if !ok {
+			continue
+		}
+
+		notificationHandlersMu.Lock()
+		actions, ok := notificationHandlers[id]
+		if signal.Name == notificationsDest+".NotificationClosed" {
+			delete(notificationHandlers, id)
+		}
+		notificationHandlersMu.Unlock()
+		if !ok || signal.Name != notificationsDest+".ActionInvoked" {
+			continue
+		}
+
+		action, _ := signal.Body[1].(string)
+		log.Println("Notification action: ", action)
+		switch action {
+		case "default", "open":
+			go actions.OpenSource()
+		case "revert":
+			go actions.Revert()
+		case "save":
+			go actions.Save()
+		}
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"github.com/gen2brain/beeep"
+)
+
+// showWallpaperNotification shows a plain notification with the thumbnail as
+// its icon; actions aren't supported here
+func showWallpaperNotification(title string, body string, icon string, actions notificationActions) error {
+	return beeep.Notify(title, body, icon)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"walltaker/flow"
+
+	"github.com/PawCorp/walltaker-desktop-client/walltaker"
+	"github.com/guregu/null"
+)
+
+// offlineShown is the post put up from the offline copy, so it isn't
+// downloaded again once Walltaker is back and still has it
+var offlineShown string
+var offlineMu sync.Mutex
+
+// followConnection goes offline when the cable drops and catches up on
+// whatever was missed once it's back
+func followConnection() {
+	app.Subscribe(func(event flow.AppEvent) {
+		if event.Kind != flow.EventConnection {
+			return
+		}
+		if !event.Connected {
+			goOffline()
+			return
+		}
+		if !app.Offline() {
+			return
+		}
+		app.SetOffline(false)
+		// following the link catches up by itself
+		if !wallpapers.WaitingForPost() {
+			go reconcileLink()
+		}
+	})
+}
+
+// goOffline marks Walltaker unreachable. With nothing on screen yet, the
+// last known post of the watched link goes up instead.
+func goOffline() {
+	if app.Offline() {
+		return
+	}
+	app.SetOffline(true)
+	if app.CurrentPost().PostURL.String == "" {
+		showOfflineWallpaper(app.Feed())
+	}
+}
+
+// showOfflineWallpaper puts up the last post applied from link feed, from
+// the copy kept of it
+func showOfflineWallpaper(feed int64) {
+	linkState, ok := lastAppliedPost(int(feed))
+	if !ok {
+		log.Println("No wallpaper known for link ", feed, ", waiting for Walltaker")
+		return
+	}
+	userData := walltaker.Link{
+		ID:        int(feed),
+		PostURL:   null.StringFrom(linkState.PostURL),
+		SetBy:     null.NewString(linkState.SetBy, linkState.SetBy != ""),
+		UpdatedAt: linkState.UpdatedAt,
+	}
+	app.SetCurrentPost(userData)
+
+	if isResumedAfterCrash() {
+		log.Println("Offline, the last wallpaper is still on screen")
+	} else {
+		file := offlineWallpaperFile(linkState.PostURL)
+		if file == "" {
+			log.Println("Offline and no copy of ", linkState.PostURL, " kept, waiting for Walltaker")
+			return
+		}
+		log.Println("Offline, putting the last wallpaper back up from ", file)
+		setAt := strings.ReplaceAll(time.Now().Format(time.RFC3339), ":", "-")
+		wallpapers.Queue.Enqueue(flow.Update{Post: userData, SetAt: setAt, File: file})
+	}
+
+	offlineMu.Lock()
+	offlineShown = linkState.PostURL
+	offlineMu.Unlock()
+}
+
+// isStillOnScreen reports whether the first post of a link is still up,
+// from the last run after a crash or from the offline copy
+func isStillOnScreen(userData walltaker.Link) bool {
+	return takeResumedAfterCrash() || shownOffline(userData)
+}
+
+// shownOffline reports whether userData's post was put up while offline,
+// and forgets it: it's only asked once Walltaker is back
+func shownOffline(userData walltaker.Link) bool {
+	offlineMu.Lock()
+	defer offlineMu.Unlock()
+	shown := offlineShown != "" && offlineShown == userData.PostURL.String
+	offlineShown = ""
+	return shown
+}
+
+// reconcileLink fetches the watched link after an outage and handles it like
+// an update, so a post set while we were offline still goes up
+func reconcileLink() {
+	feed := app.Feed()
+	userData, err := walltakerClient.GetLink(rootCtx, feed)
+	if err != nil {
+		log.Println("Could not catch up on link ", feed, ": ", err)
+		return
+	}
+	if _, noDataErr := getWallpaperUrlFromData(userData); noDataErr != nil {
+		app.SetLink(userData)
+		return
+	}
+	log.Println("Back online, catching up on link ", feed)
+	wallpapers.Received(userData)
+}
+
+// keepOfflineCopy keeps a copy of a downloaded wallpaper, from url, for post
+// postURL, to put back up when starting offline
+func keepOfflineCopy(file string, url string, postURL string) {
+	dir, err := walltakerDir()
+	if err != nil {
+		log.Println("Could not keep offline copy of wallpaper: ", err)
+		return
+	}
+	kept := filepath.Join(dir, "offline-wallpaper"+path.Ext(url))
+	err = flow.CopyFile(file, kept+".tmp")
+	if err == nil {
+		err = os.Rename(kept+".tmp", kept)
+	}
+	if err != nil {
+		os.Remove(kept + ".tmp")
+		log.Println("Could not keep offline copy of wallpaper: ", err)
+		return
+	}
+
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	if state.OfflineWallpaper != "" && state.OfflineWallpaper != kept {
+		os.Remove(state.OfflineWallpaper)
+	}
+	state.OfflineWallpaper = kept
+	state.OfflinePostURL = postURL
+	err = saveStateLocked()
+	if err != nil {
+		log.Println("Could not save state file: ", err)
+	}
+}
+
+// offlineWallpaperFile returns the kept copy of post postURL, or "" if
+// there's none
+func offlineWallpaperFile(postURL string) string {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	if state.OfflineWallpaper == "" || state.OfflinePostURL != postURL {
+		return ""
+	}
+	if _, err := os.Stat(state.OfflineWallpaper); err != nil {
+		return ""
+	}
+	return state.OfflineWallpaper
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"walltaker/config"
+	"walltaker/flow"
+
+	"github.com/PawCorp/walltaker-desktop-client/walltaker"
+	"github.com/hugolgst/rich-go/client"
+)
+
+// discordClientID is Walltaker's application on Discord
+const discordClientID = "942796233033019504"
+
+// presenceRetryInterval is how often we look for Discord while it's not
+// running
+const presenceRetryInterval = 15 * time.Second
+
+// presenceConfig is what the [Presence] section of the config says to show.
+// State, Details and LargeText may use {setter}, {since} and {link}.
+type presenceConfig struct {
+	State      string
+	Details    string
+	LargeImage string
+	LargeText  string
+	// Button is the label of a button linking to your Walltaker page, or
+	// empty for no button
+	Button string
+}
+
+// presenceManager owns the Discord Rich Presence. Discord is optional: while
+// it isn't running the manager keeps retrying in the background, and nothing
+// it does can stop Walltaker.
+type presenceManager struct {
+	mu sync.Mutex
+	// newIPC makes a connection to Discord, ipc is the one logged in
+	newIPC    func() discordIPC
+	ipc       discordIPC
+	config    presenceConfig
+	wanted    bool
+	loggedIn  bool
+	started   time.Time
+	post      walltaker.Link
+	changedAt time.Time
+	updatedAt time.Time
+	status    string
+	// onStatus is told whenever status changes, for the tray tooltip
+	onStatus func(status string)
+	wake     chan struct{}
+	running  bool
+	// failing is set after a failed attempt, so we only log the first one
+	failing bool
+}
+
+var presence = newPresenceManager(func() discordIPC { return newIPCClient() })
+
+func newPresenceManager(newIPC func() discordIPC) *presenceManager {
+	return &presenceManager{
+		newIPC: newIPC,
+		config: presenceConfig{
+			State:      config.DefaultPresenceState,
+			Details:    config.DefaultPresenceDetails,
+			LargeImage: config.DefaultPresenceLargeImage,
+			LargeText:  config.DefaultPresenceLargeText,
+		},
+		started: time.Now(),
+		status:  "Off",
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+func (p *presenceManager) configure(config presenceConfig) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.config = config
+}
+
+// sync shows the presence exactly when Discord Presence is checked and safe
+// mode is off. Connecting happens in the background, so this never blocks on
+// Discord.
+func (p *presenceManager) sync() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	settings := app.Settings()
+	p.wanted = settings.DiscordPresence && !settings.SafeMode
+	if !p.wanted {
+		if p.loggedIn {
+			p.ipc.Close()
+			p.loggedIn = false
+			log.Println("Stopped Discord Presence")
+		}
+		if settings.DiscordPresence {
+			p.setStatus("Paused in safe mode")
+		} else {
+			p.setStatus("Off")
+		}
+		return
+	}
+	if !p.loggedIn {
+		p.setStatus("Connecting to Discord...")
+	}
+	if !p.running {
+		p.running = true
+		go p.run()
+	}
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// follow keeps the presence in step with a's current post and settings
+func (p *presenceManager) follow(a *flow.App) {
+	a.Subscribe(func(event flow.AppEvent) {
+		switch event.Kind {
+		case flow.EventPost:
+			p.setPost(event.Post)
+		case flow.EventSettings:
+			if event.Settings.DiscordPresence != event.Previous.DiscordPresence ||
+				event.Settings.SafeMode != event.Previous.SafeMode {
+				p.sync()
+			}
+		case flow.EventFeed:
+			p.mu.Lock()
+			if p.loggedIn {
+				p.update()
+			}
+			p.mu.Unlock()
+		}
+	})
+}
+
+// setPost shows a new wallpaper in the presence
+func (p *presenceManager) setPost(userData walltaker.Link) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.post = userData
+	p.changedAt = time.Now()
+	if p.loggedIn {
+		p.update()
+	}
+}
+
+// watchStatus calls fn with the current status and again whenever it changes
+func (p *presenceManager) watchStatus(fn func(status string)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.onStatus = fn
+	fn(p.status)
+}
+
+// close takes the presence down for good
+func (p *presenceManager) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.wanted = false
+	if p.loggedIn {
+		p.ipc.Close()
+		p.loggedIn = false
+	}
+}
+
+// Status says what the presence is doing, e.g. "Showing on Discord"
+func (p *presenceManager) Status() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.status
+}
+
+// run connects to Discord whenever the presence is wanted but not shown,
+// and keeps {since} fresh once a minute
+func (p *presenceManager) run() {
+	ticker := time.NewTicker(presenceRetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.wake:
+		case <-ticker.C:
+		case <-rootCtx.Done():
+			return
+		}
+
+		p.mu.Lock()
+		connect := p.wanted && !p.loggedIn
+		if p.loggedIn && p.usesSince() && time.Since(p.updatedAt) >= time.Minute {
+			p.update()
+		}
+		p.mu.Unlock()
+		if connect {
+			p.connect()
+		}
+	}
+}
+
+// connect logs in to Discord. That can take a while, so it's done without
+// p.mu, and the connection is only used if the presence is still wanted.
+func (p *presenceManager) connect() {
+	ipc := p.newIPC()
+	err := ipc.Login(discordClientID)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		if !p.failing {
+			log.Println("Discord Presence could not connect, will keep trying: ", err)
+			p.failing = true
+		}
+		if p.wanted {
+			p.setStatus("Waiting for Discord")
+		}
+		return
+	}
+	p.failing = false
+	if !p.wanted || p.loggedIn {
+		ipc.Close()
+		return
+	}
+	p.ipc = ipc
+	p.loggedIn = true
+	log.Println("Started Discord Presence")
+	p.update()
+}
+
+// update sends the current activity to Discord; p.mu must be held. If that
+// fails Discord has probably quit, so we go back to waiting for it.
+func (p *presenceManager) update() {
+	err := p.ipc.SetActivity(p.activity())
+	if err != nil {
+		log.Println("Lost connection to Discord: ", err)
+		p.ipc.Close()
+		p.loggedIn = false
+		p.setStatus("Waiting for Discord")
+		return
+	}
+	p.updatedAt = time.Now()
+	p.setStatus("Showing on Discord")
+}
+
+// setStatus records status; p.mu must be held
+func (p *presenceManager) setStatus(status string) {
+	if status == p.status {
+		return
+	}
+	p.status = status
+	if p.onStatus != nil {
+		p.onStatus(status)
+	}
+}
+
+func (p *presenceManager) usesSince() bool {
+	return strings.Contains(p.config.State+p.config.Details+p.config.LargeText, "{since}")
+}
+
+func (p *presenceManager) activity() *client.PayloadActivity {
+	start := uint64(p.started.UnixNano() / int64(time.Millisecond))
+	activity := &client.PayloadActivity{
+		State:   p.format(p.config.State),
+		Details: p.format(p.config.Details),
+		Assets: client.PayloadAssets{
+			LargeImage: p.config.LargeImage,
+			LargeText:  p.format(p.config.LargeText),
+		},
+		Timestamps: &client.PayloadTimestamps{
+			Start: &start,
+		},
+	}
+	if p.config.Button != "" {
+		activity.Buttons = []*client.PayloadButton{{
+			Label: p.config.Button,
+			Url:   walltakerClient.LinkURL(app.Feed()),
+		}}
+	}
+	return activity
+}
+
+func (p *presenceManager) format(template string) string {
+	setter := p.post.SetBy.String
+	if setter == "" {
+		setter = "Anonymous"
+	}
+	since := "a while"
+	if !p.changedAt.IsZero() {
+		since = formatSince(time.Since(p.changedAt))
+	}
+	return strings.NewReplacer(
+		"{setter}", setter,
+		"{since}", since,
+		"{link}", strconv.FormatInt(app.Feed(), 10),
+	).Replace(template)
+}
+
+// formatSince rounds d for people, e.g. "just now", "5m" or "2h 10m"
+func formatSince(d time.Duration) string {
+	if d < time.Minute {
+		return "just now"
+	}
+	d = d.Round(time.Minute)
+	if d < time.Hour {
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	}
+	return fmt.Sprintf("%dh %dm", int(d.Hours()), int(d.Minutes())%60)
+}
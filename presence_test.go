@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"walltaker/flow"
+
+	"github.com/PawCorp/walltaker-desktop-client/walltaker"
+	"github.com/guregu/null"
+	"github.com/hugolgst/rich-go/client"
+)
+
+// fakeDiscord answers the IPC socket like the Discord app, over a pipe
+type fakeDiscord struct {
+	handshakes chan string
+	activities chan *client.PayloadActivity
+	// closed gets a value for every connection the client closes
+	closed chan struct{}
+	// release, if set, holds handshakes until it's closed
+	release chan struct{}
+	// refuse answers every activity with an error
+	refuse bool
+}
+
+func newFakeDiscord() *fakeDiscord {
+	return &fakeDiscord{
+		handshakes: make(chan string, 10),
+		activities: make(chan *client.PayloadActivity, 10),
+		closed:     make(chan struct{}, 10),
+	}
+}
+
+func (f *fakeDiscord) newIPC() discordIPC {
+	return &ipcClient{dial: func() (net.Conn, error) {
+		conn, server := net.Pipe()
+		go f.serve(server)
+		return conn, nil
+	}}
+}
+
+func (f *fakeDiscord) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		var header struct {
+			Opcode int32
+			Length int32
+		}
+		err := binary.Read(conn, binary.LittleEndian, &header)
+		if err != nil {
+			f.closed <- struct{}{}
+			return
+		}
+		body := make([]byte, header.Length)
+		_, err = io.ReadFull(conn, body)
+		if err != nil {
+			f.closed <- struct{}{}
+			return
+		}
+
+		switch header.Opcode {
+		case discordOpHandshake:
+			var handshake client.Handshake
+			json.Unmarshal(body, &handshake)
+			f.handshakes <- handshake.ClientId
+			if f.release != nil {
+				<-f.release
+			}
+			writeDiscordFrame(conn, discordOpFrame, `{"cmd": "DISPATCH", "evt": "READY"}`)
+		case discordOpFrame:
+			var frame client.Frame
+			json.Unmarshal(body, &frame)
+			f.activities <- frame.Args.Activity
+			if f.refuse {
+				writeDiscordFrame(conn, discordOpFrame, `{"cmd": "SET_ACTIVITY", "evt": "ERROR", "data": {"code": 4000, "message": "nope"}}`)
+			} else {
+				writeDiscordFrame(conn, discordOpFrame, `{"cmd": "SET_ACTIVITY"}`)
+			}
+		}
+	}
+}
+
+func writeDiscordFrame(conn net.Conn, opcode int32, body string) {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, opcode)
+	binary.Write(buf, binary.LittleEndian, int32(len(body)))
+	buf.WriteString(body)
+	conn.Write(buf.Bytes())
+}
+
+// withPresenceSettings sets the presence toggles for the test
+func withPresenceSettings(t *testing.T, discordPresence bool, safeMode bool) {
+	app.UpdateSettings(func(settings *flow.Settings) {
+		settings.DiscordPresence = discordPresence
+		settings.SafeMode = safeMode
+	})
+	t.Cleanup(func() {
+		app.UpdateSettings(func(settings *flow.Settings) {
+			settings.DiscordPresence = false
+			settings.SafeMode = false
+		})
+	})
+}
+
+func waitForStatus(t *testing.T, p *presenceManager, want string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for p.Status() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("status is %q, want %q", p.Status(), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (f *fakeDiscord) nextHandshake(t *testing.T) string {
+	t.Helper()
+	select {
+	case id := <-f.handshakes:
+		return id
+	case <-time.After(5 * time.Second):
+		t.Fatal("no handshake")
+		return ""
+	}
+}
+
+func (f *fakeDiscord) nextActivity(t *testing.T) *client.PayloadActivity {
+	t.Helper()
+	select {
+	case activity := <-f.activities:
+		return activity
+	case <-time.After(5 * time.Second):
+		t.Fatal("no activity")
+		return nil
+	}
+}
+
+func (f *fakeDiscord) waitClosed(t *testing.T) {
+	t.Helper()
+	select {
+	case <-f.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection wasn't closed")
+	}
+}
+
+func TestPresenceShowsPost(t *testing.T) {
+	discord := newFakeDiscord()
+	p := newPresenceManager(discord.newIPC)
+	p.configure(presenceConfig{State: "Set by {setter}", Details: "Link {link}"})
+	t.Cleanup(p.close)
+	withPresenceSettings(t, true, false)
+
+	p.setPost(walltaker.Link{ID: 123, SetBy: null.StringFrom("gray")})
+	p.sync()
+	if id := discord.nextHandshake(t); id != discordClientID {
+		t.Errorf("logged in as %q", id)
+	}
+	activity := discord.nextActivity(t)
+	if activity.State != "Set by gray" {
+		t.Errorf("activity %+v doesn't show the setter", activity)
+	}
+	waitForStatus(t, p, "Showing on Discord")
+
+	p.setPost(walltaker.Link{ID: 123, SetBy: null.StringFrom("someone")})
+	activity = discord.nextActivity(t)
+	if activity.State != "Set by someone" {
+		t.Errorf("activity %+v doesn't show the new setter", activity)
+	}
+}
+
+// Turning presence off while Discord is slow to answer mustn't wait for it,
+// and the connection that comes up late is dropped
+func TestPresenceSyncDoesNotWaitForLogin(t *testing.T) {
+	discord := newFakeDiscord()
+	discord.release = make(chan struct{})
+	p := newPresenceManager(discord.newIPC)
+	t.Cleanup(p.close)
+	withPresenceSettings(t, true, false)
+
+	p.sync()
+	discord.nextHandshake(t)
+
+	withPresenceSettings(t, true, true)
+	synced := make(chan struct{})
+	go func() {
+		p.sync()
+		close(synced)
+	}()
+	select {
+	case <-synced:
+	case <-time.After(time.Second):
+		t.Fatal("sync waited for Discord to log in")
+	}
+	if status := p.Status(); status != "Paused in safe mode" {
+		t.Errorf("status is %q", status)
+	}
+
+	close(discord.release)
+	discord.waitClosed(t)
+	select {
+	case activity := <-discord.activities:
+		t.Errorf("showed %+v in safe mode", activity)
+	default:
+	}
+	if status := p.Status(); status != "Paused in safe mode" {
+		t.Errorf("status is %q after login finished", status)
+	}
+}
+
+func TestPresenceWaitsWhenDiscordRefuses(t *testing.T) {
+	discord := newFakeDiscord()
+	discord.refuse = true
+	p := newPresenceManager(discord.newIPC)
+	t.Cleanup(p.close)
+	withPresenceSettings(t, true, false)
+
+	p.sync()
+	discord.nextActivity(t)
+	discord.waitClosed(t)
+	waitForStatus(t, p, "Waiting for Discord")
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"walltaker/flow"
+
+	"github.com/PawCorp/walltaker-desktop-client/walltaker"
+	"github.com/getlantern/systray"
+	"github.com/martinlindhe/inputbox"
+)
+
+// reaction is one of the responses in the tray's React menu
+type reaction struct {
+	Label string
+	Type  string
+}
+
+// reactions are the responses Walltaker's site offers
+var reactions = []reaction{
+	{"Horny", walltaker.ResponseHorny},
+	{"Came", walltaker.ResponseCame},
+	{"Disgust", walltaker.ResponseDisgust},
+	{"OK", walltaker.ResponseOK},
+}
+
+// addReactMenu adds the React submenu, for telling whoever set the wallpaper
+// what you think of it. It's only enabled while there's a wallpaper.
+func addReactMenu() {
+	menuReact := systray.AddMenuItem("React", "Tell whoever set your wallpaper what you think of it (needs your API key)")
+	for _, r := range reactions {
+		item := menuReact.AddSubMenuItem(r.Label, "Respond \""+r.Label+"\" to your current wallpaper")
+		go handleReactClicks(item, r)
+	}
+	menuComment := menuReact.AddSubMenuItem("Comment...", "Respond with a comment of your own")
+	go handleReactClicks(menuComment, reaction{})
+
+	if app.CurrentPost().PostURL.String == "" {
+		menuReact.Disable()
+	}
+	app.Subscribe(func(event flow.AppEvent) {
+		if event.Kind == flow.EventPost {
+			menuReact.Enable()
+		}
+	})
+}
+
+// handleReactClicks responds r whenever item is clicked. An empty r asks for
+// a comment instead.
+func handleReactClicks(item *systray.MenuItem, r reaction) {
+	for {
+		select {
+		case <-rootCtx.Done():
+			return
+		case <-item.ClickedCh:
+			if r.Type == "" {
+				go commentOnPost()
+			} else {
+				go reactToPost(walltaker.Response{Type: r.Type}, r.Label)
+			}
+		}
+	}
+}
+
+// commentOnPost asks for a comment and responds with it
+func commentOnPost() {
+	got, ok := inputbox.InputBox("React", "What do you think of your wallpaper?", "")
+	text := strings.TrimSpace(got)
+	if !ok || text == "" {
+		return
+	}
+	reactToPost(walltaker.Response{Type: walltaker.ResponseOK, Text: text}, fmt.Sprintf("%q", text))
+}
+
+// reactToPost sends response for the current wallpaper and says how it went
+func reactToPost(response walltaker.Response, label string) {
+	setter := app.SetterName()
+	if setter == "" {
+		setter = "Anonymous"
+	}
+	err := respondToPost(response)
+	notifyActionResult(fmt.Sprintf("Told %s: %s~", setter, label), err)
+}
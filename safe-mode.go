@@ -0,0 +1,50 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+)
+
+// safeModeRequests carries safe mode toggles coming from outside the tray menu
+// (signals, screen share detection) to the menu loop, which owns the state
+var safeModeRequests = make(chan bool, 1)
+
+func requestSafeMode(on bool) {
+	select {
+	case safeModeRequests <- on:
+	default:
+		// a request is already pending; replace it with the newest one
+		select {
+		case <-safeModeRequests:
+		default:
+		}
+		safeModeRequests <- on
+	}
+}
+
+// watchForScreenShare polls for known screen sharing processes and turns safe
+// mode on while one is running. Safe mode is only turned back off if it was
+// turned on by the watcher.
+func watchForScreenShare(processes []string) {
+	if !screenShareDetectionSupported {
+		log.Println("Screen share detection is not supported on this OS")
+		return
+	}
+	log.Println("Watching for screen sharing apps: ", strings.Join(processes, ", "))
+	detected := false
+	enabledByWatcher := false
+	for sleepCtx(rootCtx, 5*time.Second) {
+		running := screenShareRunning(processes)
+		if running && !detected && !app.Settings().SafeMode {
+			log.Println("Screen sharing app detected, entering safe mode")
+			enabledByWatcher = true
+			requestSafeMode(true)
+		} else if !running && detected && enabledByWatcher {
+			log.Println("Screen sharing app closed, leaving safe mode")
+			enabledByWatcher = false
+			requestSafeMode(false)
+		}
+		detected = running
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"walltaker/config"
+	"walltaker/e621"
+
+	"github.com/PawCorp/walltaker-desktop-client/walltaker"
+	"github.com/kardianos/osext"
+)
+
+var saveDirectory string = ""
+var saveFilenameTemplate string = config.DefaultSaveFilename
+
+// artist tags e621 uses for things that aren't artists
+var nonArtistTags = map[string]bool{
+	"conditional_dnp":  true,
+	"sound_warning":    true,
+	"unknown_artist":   true,
+	"epilepsy_warning": true,
+	"avoid_posting":    true,
+}
+
+// windowsReservedNames can't be used as a file name on Windows, with or
+// without an extension
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// resolveSaveDirectory returns the folder wallpapers are saved to, creating
+// it if needed. An empty saveDirectory means the download folder next to the
+// executable; relative paths are relative to the executable too. If the folder
+// can't be created (e.g. a read-only install location) we fall back to
+// Pictures/Walltaker in the user's home.
+func resolveSaveDirectory() (string, error) {
+	folderPath, err := osext.ExecutableFolder()
+	if err != nil {
+		return "", err
+	}
+
+	dir := saveDirectory
+	if dir == "" {
+		dir = filepath.Join(folderPath, "download")
+	} else if strings.HasPrefix(dir, "~") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(home, dir[1:])
+	} else if !filepath.IsAbs(dir) {
+		dir = filepath.Join(folderPath, dir)
+	}
+
+	err = ensureWritableDir(dir)
+	if err == nil {
+		return dir, nil
+	}
+	log.Println("Can't save wallpapers to ", dir, ": ", err)
+
+	home, homeErr := os.UserHomeDir()
+	if homeErr != nil {
+		return "", err
+	}
+	fallback := filepath.Join(home, "Pictures", "Walltaker")
+	log.Println("Saving wallpapers to ", fallback, " instead")
+	return fallback, ensureWritableDir(fallback)
+}
+
+func ensureWritableDir(dir string) error {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		log.Println("Created save directory since it did not exist: ", dir)
+		err = os.MkdirAll(dir, os.FileMode(0777))
+		if err != nil {
+			return err
+		}
+	}
+	probe, err := os.CreateTemp(dir, ".walltaker-write-test")
+	if err != nil {
+		return err
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+// formatSaveFilename fills in the filename template. Supported fields are
+// {setter}, {link}, {post}, {md5}, {artist}, {rating}, {date} and {ext}; a
+// "/" in the template makes sub folders. post may be nil if e621 doesn't know
+// the image.
+func formatSaveFilename(template string, url string, setterName string, setAt string, linkID int, post *e621.Post) string {
+	fields := map[string]string{
+		"{setter}": setterName,
+		"{link}":   strconv.Itoa(linkID),
+		"{md5}":    e621.ExtractMD5(url),
+		"{date}":   setAt,
+		"{ext}":    strings.TrimPrefix(path.Ext(url), "."),
+		"{post}":   "unknown",
+		"{artist}": "unknown",
+		"{rating}": "unknown",
+	}
+
+	if post != nil {
+		fields["{post}"] = strconv.Itoa(post.ID)
+		fields["{rating}"] = post.Rating
+		artists := postArtists(post)
+		if len(artists) > 0 {
+			fields["{artist}"] = strings.Join(artists, "+")
+		}
+	}
+
+	// in one pass, so a value that looks like a field isn't filled in again
+	var replacements []string
+	for field, value := range fields {
+		replacements = append(replacements, field, sanitizeFilename(value))
+	}
+	replacer := strings.NewReplacer(replacements...)
+	parts := strings.Split(template, "/")
+	for i, part := range parts {
+		parts[i] = sanitizeFilename(replacer.Replace(part))
+	}
+	return filepath.Join(parts...)
+}
+
+// postArtists returns the post's artist tags, minus the ones that aren't artists
+func postArtists(post *e621.Post) []string {
+	artists := []string{}
+	for _, artist := range post.Tags.Artist {
+		if !nonArtistTags[artist] {
+			artists = append(artists, artist)
+		}
+	}
+	return artists
+}
+
+// sanitizeFilename makes a single path component that is valid on Windows,
+// macOS and Linux alike
+func sanitizeFilename(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || strings.ContainsRune(`<>:"/\|?*`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.TrimRight(name, ". ")
+	if name == "" {
+		return "_"
+	}
+	base := strings.ToUpper(strings.SplitN(name, ".", 2)[0])
+	if windowsReservedNames[base] {
+		name = "_" + name
+	}
+	if len(name) > 200 {
+		ext := path.Ext(name)
+		if len(ext) > 20 {
+			ext = ""
+		}
+		name = strings.ToValidUTF8(name[:200-len(ext)], "") + ext
+	}
+	return name
+}
+
+func saveWallpaperLocally(userData walltaker.Link, setAt string) {
+	url := userData.PostURL.String
+	setterName := userData.SetBy.String
+	if setterName == "" {
+		setterName = "anonymous"
+	}
+	set := WallpaperSet{
+		SetBy:  setterName,
+		LinkID: userData.ID,
+		SetAt:  time.Now(),
+	}
+
+	// e621 names files by their MD5, so most repeats are caught before downloading
+	if existing, ok := findDuplicateByMD5(e621.ExtractMD5(url)); ok {
+		log.Println("Wallpaper was already saved as ", existing.File, ", not saving it again")
+		err := recordRepeatSet(existing, set)
+		if err != nil {
+			log.Println("Could not record repeat wallpaper: ", err)
+		}
+		return
+	}
+
+	folderPath, err := resolveSaveDirectory()
+	if err != nil {
+		log.Println("Could not save wallpaper: ", err)
+		return
+	}
+
+	post := lookupPost(url)
+
+	filename := filepath.Join(folderPath, formatSaveFilename(saveFilenameTemplate, url, setterName, setAt, userData.ID, post))
+	_, err = os.Stat(filename)
+
+	if os.IsNotExist(err) {
+		err = os.MkdirAll(filepath.Dir(filename), os.FileMode(0777))
+		if err != nil {
+			log.Println("Could not save wallpaper: ", err)
+			return
+		}
+
+		//log.Printf("Downloading", url, " to ", filename)
+		tmpFile, contentMD5, err := downloadForSaving(url, folderPath)
+		if err != nil {
+			log.Println("Could not save wallpaper: ", err)
+			return
+		}
+		defer os.Remove(tmpFile) // no-op once renamed
+
+		existing, duplicate := findDuplicateByMD5(contentMD5)
+		phash := ""
+		if !duplicate && dedupSimilar {
+			hash, err := perceptualHash(tmpFile)
+			if err == nil {
+				phash = formatPerceptualHash(hash)
+				existing, duplicate = findSimilarImage(hash)
+			}
+		}
+		if duplicate {
+			log.Println("Wallpaper was already saved as ", existing.File, ", not saving it again")
+			err = recordRepeatSet(existing, set)
+			if err != nil {
+				log.Println("Could not record repeat wallpaper: ", err)
+			}
+			return
+		}
+
+		err = os.Rename(tmpFile, filename)
+		if err != nil {
+			log.Println("Could not save wallpaper: ", err)
+			return
+		}
+
+		metadata := WallpaperMetadata{
+			LinkID:    userData.ID,
+			SetBy:     setterName,
+			SetAt:     setAt,
+			File:      filepath.Base(filename),
+			Walltaker: userData,
+			E621Post:  post,
+			Sets:      []WallpaperSet{set},
+		}
+		err = writeSidecar(filename, metadata)
+		if err != nil {
+			log.Println("Could not write metadata for saved wallpaper: ", err)
+		}
+		entry := newGalleryEntry(filename, contentMD5, metadata, set.SetAt)
+		entry.PHash = phash
+		err = addToGallery(entry)
+		if err != nil {
+			log.Println("Could not add saved wallpaper to the gallery: ", err)
+		}
+	} else {
+		log.Printf("Wallpaper file already exists, skipping! ")
+	}
+	return
+}
+
+// downloadForSaving downloads url into a temporary file in dir, returning the
+// file and the MD5 of its content
+func downloadForSaving(url string, dir string) (string, string, error) {
+	response, err := http.Get(url)
+	if err != nil {
+		return "", "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return "", "", fmt.Errorf("got status %d", response.StatusCode)
+	}
+
+	file, err := os.CreateTemp(dir, ".walltaker-download-*")
+	if err != nil {
+		return "", "", err
+	}
+	hash := md5.New()
+	_, err = io.Copy(io.MultiWriter(file, hash), response.Body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", "", err
+	}
+	return file.Name(), hex.EncodeToString(hash.Sum(nil)), nil
+}
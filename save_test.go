@@ -0,0 +1,35 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"walltaker/e621"
+)
+
+func TestFormatSaveFilename(t *testing.T) {
+	url := "https://static1.e621.net/data/ab/cd/0123456789abcdef0123456789abcdef.png"
+	post := &e621.Post{ID: 42, Rating: "s"}
+	post.Tags.Artist = []string{"someone"}
+
+	for _, test := range []struct {
+		template string
+		setter   string
+		post     *e621.Post
+		want     string
+	}{
+		{"{setter}_{md5}.{ext}", "gray", post, "gray_0123456789abcdef0123456789abcdef.png"},
+		{"{artist}/{post}-{rating}.{ext}", "gray", post, filepath.Join("someone", "42-s.png")},
+		{"{link}/{post}.{ext}", "gray", nil, filepath.Join("123", "unknown.png")},
+		// a setter named like a field stays as it is
+		{"{setter}_{md5}.{ext}", "{md5}", post, "{md5}_0123456789abcdef0123456789abcdef.png"},
+		{"{setter}-{post}", "{post}{link}", nil, "{post}{link}-unknown"},
+	} {
+		for i := 0; i < 20; i++ {
+			got := formatSaveFilename(test.template, url, test.setter, "2022-09-13T10-00-00Z", 123, test.post)
+			if got != test.want {
+				t.Fatalf("%s with setter %q: got %q, want %q", test.template, test.setter, got, test.want)
+			}
+		}
+	}
+}
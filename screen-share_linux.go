@@ -0,0 +1,35 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const screenShareDetectionSupported = true
+
+// screenShareRunning reports whether any process in /proc has one of the given
+// names. Names are compared case-insensitively against /proc/<pid>/comm, which
+// the kernel truncates to 15 characters.
+func screenShareRunning(processes []string) bool {
+	comms, err := filepath.Glob("/proc/[0-9]*/comm")
+	if err != nil {
+		return false
+	}
+	for _, comm := range comms {
+		dat, err := os.ReadFile(comm)
+		if err != nil {
+			continue // process exited while we were looking
+		}
+		name := strings.TrimSpace(string(dat))
+		for _, p := range processes {
+			if len(p) > 15 {
+				p = p[:15]
+			}
+			if strings.EqualFold(name, p) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+const screenShareDetectionSupported = false
+
+func screenShareRunning(processes []string) bool {
+	return false
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// shutdownTimeout bounds how long quitting may take, a stuck download or save
+// must not keep Walltaker from exiting
+const shutdownTimeout = 10 * time.Second
+
+// rootCtx is cancelled when Walltaker quits. Everything that runs in the
+// background stops when it's done.
+var rootCtx, cancelRoot = context.WithCancel(context.Background())
+
+var shutdownOnce sync.Once
+
+// shutdown stops background work, waits for a wallpaper update or save in
+// progress, then puts the original wallpaper back and writes the state file.
+// It only does this once, however many ways Walltaker is told to quit.
+func shutdown() {
+	shutdownOnce.Do(func() {
+		log.Println("Shutting down...")
+		cancelRoot()
+
+		done := make(chan struct{})
+		go func() {
+			wallpapers.Queue.Wait()
+			presence.close()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(shutdownTimeout):
+			log.Println("Gave up waiting for background work after ", shutdownTimeout)
+		}
+
+		wallpapers.RestoreOriginal()
+		forgetOriginalWallpaper()
+		log.Println("Bye!")
+	})
+}
+
+// sleepCtx waits for d, returning false if ctx is cancelled first
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/json"
+
+	"walltaker/e621"
+
+	"github.com/PawCorp/walltaker-desktop-client/walltaker"
+)
+
+// WallpaperMetadata is written as a JSON sidecar next to every saved
+// wallpaper, so the context of the image isn't lost to the filename
+type WallpaperMetadata struct {
+	LinkID    int            `json:"link_id"`
+	SetBy     string         `json:"set_by"`
+	SetAt     string         `json:"set_at"`
+	File      string         `json:"file"`
+	Walltaker walltaker.Link `json:"walltaker"`
+	E621Post  *e621.Post     `json:"e621_post"`
+	// Sets is every time this image was sent, starting with the one that
+	// saved it
+	Sets []WallpaperSet `json:"sets"`
+}
+
+// sidecarPath returns where the metadata for a saved wallpaper lives, e.g.
+// walltaker_gray_2022-09-13_abc.png.json
+func sidecarPath(filename string) string {
+	return filename + ".json"
+}
+
+func writeSidecar(filename string, metadata WallpaperMetadata) error {
+	dat, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(sidecarPath(filename), dat)
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/getlantern/systray"
+)
+
+// handleExitSignals quits the tray on SIGINT, SIGTERM or SIGHUP, so the
+// original wallpaper is restored by onExit like it is for the QUIT item
+func handleExitSignals() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		sig := <-c
+		log.Println("Got ", sig, ", quitting...")
+		systray.Quit()
+	}()
+}
@@ -0,0 +1,24 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// handleSafeModeSignal toggles safe mode on SIGUSR1, so a desktop hotkey can
+// run `pkill -USR1 walltaker` to hide the wallpaper instantly
+func handleSafeModeSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1)
+	go func() {
+		for range c {
+			log.Println("Got SIGUSR1, toggling safe mode")
+			requestSafeMode(!app.Settings().SafeMode)
+		}
+	}()
+}
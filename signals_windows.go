@@ -0,0 +1,5 @@
+package main
+
+// Windows has no user signals, hotkeys toggle safe mode through the
+// dashboard instead
+func handleSafeModeSignal() {}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"log"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"walltaker/config"
+	"walltaker/e621"
+
+	"github.com/pkg/browser"
+)
+
+// postSource is where a post URL comes from, and what can be found out about
+// the post there. Sources without metadata still show and save the image.
+type postSource interface {
+	// Name is shown in the tray, like "e621"
+	Name() string
+	// Matches reports whether postURL is from this source
+	Matches(postURL string) bool
+	// Lookup finds the post's metadata, nil if the source has none
+	Lookup(postURL string) (*e621.Post, error)
+	// PageURL is the page to open for the post
+	PageURL(postURL string) string
+	// WallpaperURL is what to download for the wallpaper: postURL, or a
+	// smaller version if it's too big to set
+	WallpaperURL(postURL string) string
+}
+
+// maxWallpaperSize is the largest file Windows reliably sets as a wallpaper
+const maxWallpaperSize = 17000000
+
+var e926Client = newE926Client()
+
+func newE926Client() *e621.Client {
+	client := e621.NewClient(e621UserAgent(""))
+	client.BaseURL = config.DefaultE926
+	return client
+}
+
+// postSources are tried in order, the last matches anything
+var postSources = []postSource{
+	&booruSource{name: "e621", domain: "e621.net", client: e621Client},
+	&booruSource{name: "e926", domain: "e926.net", client: e926Client},
+	genericSource{},
+}
+
+// sourceFor finds the source of postURL
+func sourceFor(postURL string) postSource {
+	for _, source := range postSources {
+		if source.Matches(postURL) {
+			return source
+		}
+	}
+	return genericSource{}
+}
+
+// lookupPost finds the post's metadata from its source, nil if there's none
+func lookupPost(postURL string) *e621.Post {
+	if postURL == "" {
+		return nil
+	}
+	source := sourceFor(postURL)
+	post, err := source.Lookup(postURL)
+	if err != nil {
+		log.Println("Could not look up post on ", source.Name(), ": ", err)
+	}
+	return post
+}
+
+func openSourcePage(postURL string) {
+	if postURL != "" {
+		browser.OpenURL(sourceFor(postURL).PageURL(postURL))
+	}
+}
+
+var md5Filename = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// booruSource is e621 or a site with its API, like e926. Files are looked up
+// by the MD5 in their name.
+type booruSource struct {
+	name   string
+	domain string
+	client *e621.Client
+}
+
+func (s *booruSource) Name() string {
+	return s.name
+}
+
+// Matches takes URLs on the site's domain, and on the host the client is
+// pointed at, e.g. the fake server
+func (s *booruSource) Matches(postURL string) bool {
+	host := urlHost(postURL)
+	if host == "" {
+		return false
+	}
+	return host == s.domain || strings.HasSuffix(host, "."+s.domain) || host == urlHost(s.client.BaseURL)
+}
+
+func (s *booruSource) Lookup(postURL string) (*e621.Post, error) {
+	md5 := s.md5(postURL)
+	if md5 == "" {
+		return nil, nil
+	}
+	postsData, err := s.client.PostsByMD5(rootCtx, md5)
+	if err != nil || len(postsData.Posts) == 0 {
+		return nil, err
+	}
+	return &postsData.Posts[0], nil
+}
+
+// PageURL is the post's page, or a search for its MD5 if it can't be found
+// right now
+func (s *booruSource) PageURL(postURL string) string {
+	post := lookupPost(postURL)
+	if post != nil {
+		return s.client.PostURL(post.ID)
+	}
+	if md5 := s.md5(postURL); md5 != "" {
+		return s.client.SearchByMD5URL(md5)
+	}
+	return postURL
+}
+
+func (s *booruSource) WallpaperURL(postURL string) string {
+	post := lookupPost(postURL)
+	if post != nil && post.File.Size > maxWallpaperSize && post.Sample.URL != "" {
+		return post.Sample.URL
+	}
+	return postURL
+}
+
+func (s *booruSource) md5(postURL string) string {
+	md5 := strings.ToLower(e621.ExtractMD5(postURL))
+	if !md5Filename.MatchString(md5) {
+		return ""
+	}
+	return md5
+}
+
+// genericSource is any other image URL: no metadata, and its page is the
+// image itself
+type genericSource struct{}
+
+func (genericSource) Name() string {
+	return "source"
+}
+
+func (genericSource) Matches(postURL string) bool {
+	return true
+}
+
+func (genericSource) Lookup(postURL string) (*e621.Post, error) {
+	return nil, nil
+}
+
+func (genericSource) PageURL(postURL string) string {
+	return postURL
+}
+
+func (genericSource) WallpaperURL(postURL string) string {
+	return postURL
+}
+
+func urlHost(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"walltaker/flow"
+
+	"github.com/PawCorp/walltaker-desktop-client/walltaker"
+)
+
+// State is what Walltaker remembers between runs, kept in the cache dir next
+// to the logs so a crash or kill doesn't lose it
+type State struct {
+	OriginalWallpaper     string               `json:"original_wallpaper"`
+	OriginalWallpaperCopy string               `json:"original_wallpaper_copy"`
+	Links                 map[string]LinkState `json:"links"`
+	Sessions              int                  `json:"sessions"`
+	LastSessionStart      time.Time            `json:"last_session_start"`
+	WallpapersSet         int                  `json:"wallpapers_set"`
+	// OfflineWallpaper is a copy of the last wallpaper downloaded, the post
+	// at OfflinePostURL, for starting without a connection
+	OfflineWallpaper string `json:"offline_wallpaper,omitempty"`
+	OfflinePostURL   string `json:"offline_post_url,omitempty"`
+}
+
+// LinkState is the last post applied from a link
+type LinkState struct {
+	PostURL   string    `json:"post_url"`
+	SetBy     string    `json:"set_by"`
+	UpdatedAt time.Time `json:"updated_at"`
+	AppliedAt time.Time `json:"applied_at"`
+}
+
+var state State
+var stateMu sync.Mutex
+
+// resumedAfterCrash is set when the last run never restored the original
+// wallpaper, meaning its last Walltaker image is still on screen. It's read
+// from the cable's goroutine too, so stateMu guards it.
+var resumedAfterCrash bool = false
+
+// isResumedAfterCrash reports whether the last run's wallpaper is still up
+func isResumedAfterCrash() bool {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	return resumedAfterCrash
+}
+
+// takeResumedAfterCrash is isResumedAfterCrash, but only the first time
+func takeResumedAfterCrash() bool {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	resumed := resumedAfterCrash
+	resumedAfterCrash = false
+	return resumed
+}
+
+// walltakerDir returns (and creates) the .walltaker folder in the user cache dir
+func walltakerDir() (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	wtCacheDir := filepath.Join(cacheDir, ".walltaker")
+	if _, err := os.Stat(wtCacheDir); os.IsNotExist(err) {
+		err := os.Mkdir(wtCacheDir, os.FileMode(0777))
+		if err != nil {
+			return "", err
+		}
+	}
+	return wtCacheDir, nil
+}
+
+func stateFilePath() (string, error) {
+	dir, err := walltakerDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "state.json"), nil
+}
+
+func loadState() {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	statePath, err := stateFilePath()
+	if err != nil {
+		log.Println("Could not find state directory: ", err)
+		return
+	}
+	dat, err := os.ReadFile(statePath)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		log.Println("Could not read state file: ", err)
+		return
+	}
+	err = json.Unmarshal(dat, &state)
+	if err != nil {
+		log.Println("State file is corrupt, starting fresh: ", err)
+		state = State{}
+	}
+}
+
+// saveStateLocked writes the state file atomically, so a crash mid-write never
+// leaves a half written file behind. stateMu must be held.
+func saveStateLocked() error {
+	statePath, err := stateFilePath()
+	if err != nil {
+		return err
+	}
+	dat, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(statePath, dat)
+}
+
+func writeFileAtomic(filename string, dat []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	_, err = tmp.Write(dat)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// rememberOriginalWallpaper persists the original wallpaper and a copy of its
+// file, unless one is already remembered from a run that didn't exit cleanly
+func rememberOriginalWallpaper(bg string) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	if state.OriginalWallpaper != "" {
+		log.Println("Walltaker did not exit cleanly last time, keeping original wallpaper: ", state.OriginalWallpaper)
+		resumedAfterCrash = true
+		return
+	}
+
+	state.OriginalWallpaper = bg
+	state.OriginalWallpaperCopy = ""
+	dir, err := walltakerDir()
+	if err == nil {
+		copyPath := filepath.Join(dir, "original-wallpaper"+filepath.Ext(bg))
+		err = flow.CopyFile(bg, copyPath)
+		if err == nil {
+			state.OriginalWallpaperCopy = copyPath
+		}
+	}
+	if err != nil {
+		log.Println("Could not back up original wallpaper: ", err)
+	}
+
+	err = saveStateLocked()
+	if err != nil {
+		log.Println("Could not save state file: ", err)
+	}
+}
+
+// forgetOriginalWallpaper is called once the original wallpaper is back, so the
+// next run picks up whatever wallpaper the user has then
+func forgetOriginalWallpaper() {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	if state.OriginalWallpaperCopy != "" {
+		os.Remove(state.OriginalWallpaperCopy)
+	}
+	state.OriginalWallpaper = ""
+	state.OriginalWallpaperCopy = ""
+	err := saveStateLocked()
+	if err != nil {
+		log.Println("Could not save state file: ", err)
+	}
+}
+
+// originalWallpaperFile returns the original wallpaper if it still exists, or
+// the backup copy of it otherwise
+func originalWallpaperFile() string {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	if _, err := os.Stat(state.OriginalWallpaper); err == nil || state.OriginalWallpaperCopy == "" {
+		return state.OriginalWallpaper
+	}
+	return state.OriginalWallpaperCopy
+}
+
+// startSession bumps the session counter
+func startSession() {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	state.Sessions++
+	state.LastSessionStart = time.Now()
+	err := saveStateLocked()
+	if err != nil {
+		log.Println("Could not save state file: ", err)
+	}
+}
+
+func linkStateKey(linkID int) string {
+	return strconv.Itoa(linkID)
+}
+
+// lastAppliedPost returns the last post applied from the given link
+func lastAppliedPost(linkID int) (LinkState, bool) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	linkState, ok := state.Links[linkStateKey(linkID)]
+	return linkState, ok
+}
+
+// isAlreadyApplied reports whether this post, from the same setter, was the
+// last one applied from its link, possibly in an earlier run. UpdatedAt
+// isn't compared: Walltaker bumps it for responses, renewals and edited
+// terms too.
+func isAlreadyApplied(userData walltaker.Link) bool {
+	linkState, ok := lastAppliedPost(userData.ID)
+	return ok && linkState.PostURL == userData.PostURL.String && linkState.SetBy == userData.SetBy.String
+}
+
+func recordAppliedPost(userData walltaker.Link) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	if state.Links == nil {
+		state.Links = map[string]LinkState{}
+	}
+	state.Links[linkStateKey(userData.ID)] = LinkState{
+		PostURL:   userData.PostURL.String,
+		SetBy:     userData.SetBy.String,
+		UpdatedAt: userData.UpdatedAt,
+		AppliedAt: time.Now(),
+	}
+	state.WallpapersSet++
+	addToHistory(userData)
+	err := saveStateLocked()
+	if err != nil {
+		log.Println("Could not save state file: ", err)
+	}
+}
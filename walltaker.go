@@ -3,234 +3,90 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
-	"os/signal"
-	"path"
 	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
 	"time"
 
+	"walltaker/backend"
+	"walltaker/config"
+	"walltaker/e621"
+	"walltaker/flow"
 	"walltaker/icon"
 
-	"github.com/gen2brain/beeep"
+	"github.com/PawCorp/walltaker-desktop-client/walltaker"
 	"github.com/getlantern/systray"
-	"github.com/guregu/null"
-	"github.com/hugolgst/rich-go/client"
 	"github.com/juju/fslock"
 	"github.com/kardianos/osext"
 	"github.com/martinlindhe/inputbox"
-	"github.com/pelletier/go-toml"
 	"github.com/pkg/browser"
-	"github.com/potato2003/actioncable-client-go"
-	"github.com/reujab/wallpaper"
 )
 
-type Pref struct {
-	setterName      string
-	saveLocally     bool
-	notifications   bool
-	oldWallpaperUrl string
-}
-
-func (p *Pref) setSetterName(newSetterName string) {
-	fmt.Println("CALLED setSetterName()")
-	fmt.Println(newSetterName)
-	p.setterName = newSetterName
-}
-
-func (p *Pref) setSaveLocally(newSaveLocally bool) {
-	fmt.Println("CALLED setSaveLocally()")
-	fmt.Println(newSaveLocally)
-	p.saveLocally = newSaveLocally
-}
-
-func (p *Pref) setNotifications(newNotifications bool) {
-	fmt.Println("CALLED setNotifications()")
-	fmt.Println(newNotifications)
-	p.notifications = newNotifications
-}
-
-func (p *Pref) setOldWallpaperUrl(newOldWallpaperUrl string) {
-	fmt.Println("CALLED setOldWallpaperUrl()")
-	fmt.Println(newOldWallpaperUrl)
-	p.oldWallpaperUrl = newOldWallpaperUrl
-}
-
-var pref Pref
-
-var setterName string = ""
-var menuAppSetBy *systray.MenuItem = systray.AddMenuItem("-", "Who sent your most recent wallpaper~")
-var saveLocally bool = false
-var notifications bool = false
-
-type LinkSubscriptionEventHandler struct {
-	actioncable.SubscriptionEventHandler
-}
-
-func (h *LinkSubscriptionEventHandler) OnConnected(se *actioncable.SubscriptionEvent) {
-	fmt.Println("on connected")
-}
-
-func (h *LinkSubscriptionEventHandler) OnDisconnected(se *actioncable.SubscriptionEvent) {
-	fmt.Println("on disconnected")
-}
-
-func (h *LinkSubscriptionEventHandler) OnRejected(se *actioncable.SubscriptionEvent) {
-	fmt.Println("on rejected")
-}
-
-func (h *LinkSubscriptionEventHandler) OnReceived(se *actioncable.SubscriptionEvent) {
-	userData := WalltakerData{}
-	se.ReadJSON(&userData)
-	wallpaperUrl := userData.PostURL.String
-	log.Println("New Image... ")
-	if wallpaperUrl != pref.oldWallpaperUrl {
-		pref.setSetterName(userData.SetBy.String)
-		setterName = userData.SetBy.String
-		setAt := strings.ReplaceAll(time.Now().Format(time.RFC3339), ":", "-")
-		if setterName != "" {
-			log.Printf(setterName)
-			log.Printf(" set your wallpaper! Setting... ")
-			menuAppSetBy.SetTitle(fmt.Sprintf("Set by %s", setterName))
-		} else {
-			log.Printf("New wallpaper found! Setting... ")
-			menuAppSetBy.SetTitle(fmt.Sprintf("Set by %s", "Anonymous"))
-		}
-		pref.setOldWallpaperUrl(wallpaperUrl)
-		goSetWallpaper(wallpaperUrl, saveLocally, setterName, setAt, notifications)
-		log.Printf("Set!")
-		log.Printf("\r\n")
-	}
-}
-
 var VERSION string = "v2.1.0"
 
-type WalltakerData struct {
-	ID               int         `json:"id"`
-	Expires          time.Time   `json:"expires"`
-	UserID           int         `json:"user_id"`
-	Terms            string      `json:"terms"`
-	Blacklist        string      `json:"blacklist"`
-	PostURL          null.String `json:"post_url"`
-	PostThumbnailURL interface{} `json:"post_thumbnail_url"`
-	PostDescription  interface{} `json:"post_description"`
-	CreatedAt        time.Time   `json:"created_at"`
-	UpdatedAt        time.Time   `json:"updated_at"`
-	SetBy            null.String `json:"set_by"`
-	URL              string      `json:"url"`
-}
-
-type E621PostsData struct {
-	Posts []struct {
-		ID        int    `json:"id"`
-		CreatedAt string `json:"created_at"`
-		UpdatedAt string `json:"updated_at"`
-		File      struct {
-			Width  int    `json:"width"`
-			Height int    `json:"height"`
-			Ext    string `json:"ext"`
-			Size   int    `json:"size"`
-			Md5    string `json:"md5"`
-			URL    string `json:"url"`
-		} `json:"file"`
-		Preview struct {
-			Width  int    `json:"width"`
-			Height int    `json:"height"`
-			URL    string `json:"url"`
-		} `json:"preview"`
-		Sample struct {
-			Has        bool   `json:"has"`
-			Height     int    `json:"height"`
-			Width      int    `json:"width"`
-			URL        string `json:"url"`
-			Alternates struct {
-			} `json:"alternates"`
-		} `json:"sample"`
-		Score struct {
-			Up    int `json:"up"`
-			Down  int `json:"down"`
-			Total int `json:"total"`
-		} `json:"score"`
-		Tags struct {
-			General   []string      `json:"general"`
-			Species   []string      `json:"species"`
-			Character []string      `json:"character"`
-			Copyright []string      `json:"copyright"`
-			Artist    []string      `json:"artist"`
-			Invalid   []interface{} `json:"invalid"`
-			Lore      []interface{} `json:"lore"`
-			Meta      []string      `json:"meta"`
-		} `json:"tags"`
-		LockedTags []interface{} `json:"locked_tags"`
-		ChangeSeq  int           `json:"change_seq"`
-		Flags      struct {
-			Pending      bool `json:"pending"`
-			Flagged      bool `json:"flagged"`
-			NoteLocked   bool `json:"note_locked"`
-			StatusLocked bool `json:"status_locked"`
-			RatingLocked bool `json:"rating_locked"`
-			Deleted      bool `json:"deleted"`
-		} `json:"flags"`
-		Rating        string        `json:"rating"`
-		FavCount      int           `json:"fav_count"`
-		Sources       []string      `json:"sources"`
-		Pools         []interface{} `json:"pools"`
-		Relationships struct {
-			ParentID          interface{}   `json:"parent_id"`
-			HasChildren       bool          `json:"has_children"`
-			HasActiveChildren bool          `json:"has_active_children"`
-			Children          []interface{} `json:"children"`
-		} `json:"relationships"`
-		ApproverID   int         `json:"approver_id"`
-		UploaderID   int         `json:"uploader_id"`
-		Description  string      `json:"description"`
-		CommentCount int         `json:"comment_count"`
-		IsFavorited  bool        `json:"is_favorited"`
-		HasNotes     bool        `json:"has_notes"`
-		Duration     interface{} `json:"duration"`
-	} `json:"posts"`
-}
-
-func getWalltakerData(url string) WalltakerData {
-	webClient := http.Client{
-		Timeout: time.Second * 2, // Timeout after 2 seconds
+// userAgent is sent with every request to Walltaker, and to e621 with who
+// to contact added
+var userAgent = "Walltaker Go Client/" + VERSION + "-" + runtime.GOOS
+
+var walltakerClient = walltaker.NewClient(userAgent)
+var e621Client = e621.NewClient(e621UserAgent(""))
+
+// wallpapers puts the watched link's posts on this desktop
+var wallpapers *flow.Flow
+
+// wallpapers is set up in init, its hooks queue on it again (a
+// notification's Revert button) and Go won't initialize a loop like that
+func init() {
+	wallpapers = flow.New(rootCtx, walltakerClient, backend.System{}, app)
+	wallpapers.Hooks = flow.Hooks{
+		Applied:  isAlreadyApplied,
+		Record:   recordAppliedPost,
+		NewPost:  checkBlacklist,
+		OnScreen: isStillOnScreen,
+		WallpaperURL: func(postURL string) string {
+			return sourceFor(postURL).WallpaperURL(postURL)
+		},
+		Downloaded: keepOfflineCopy,
+		Notify:     notifyNewWallpaper,
+		Save:       saveWallpaperLocally,
+		Offline:    goOffline,
+		Original:   originalWallpaperFile,
 	}
+}
 
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+// configureClients points the API clients where the config says, with the
+// API keys if there are any, and caches e621 lookups
+func configureClients(cfg config.Config) {
+	walltakerClient.BaseURL = cfg.WalltakerURL()
+	setAPIKey(loadAPIKey(cfg.APIKey))
+	e621Client.BaseURL = cfg.E621
+	e926Client.BaseURL = cfg.E926
+	dir, err := walltakerDir()
 	if err != nil {
-		log.Fatal(err)
-	}
-
-	req.Header.Set("User-Agent", "Walltaker Go Client/"+VERSION+"-"+runtime.GOOS)
-
-	res, getErr := webClient.Do(req)
-	if getErr != nil {
-		log.Fatal(getErr)
-	}
-
-	if res.Body != nil {
-		defer res.Body.Close()
+		log.Println("Could not find cache directory, not caching e621 lookups: ", err)
 	}
-
-	body, readErr := ioutil.ReadAll(res.Body)
-	if readErr != nil {
-		log.Fatal(readErr)
+	// e926 is e621's safe side, with the same API and accounts
+	for name, client := range map[string]*e621.Client{"e621": e621Client, "e926": e926Client} {
+		client.UserAgent = e621UserAgent(cfg.E621Account.Contact)
+		client.Username = cfg.E621Account.Username
+		client.APIKey = cfg.E621Account.APIKey
+		if err == nil {
+			client.Cache = e621.NewCache(filepath.Join(dir, name))
+		}
 	}
+}
 
-	userData := WalltakerData{}
-	jsonErr := json.Unmarshal(body, &userData)
-	if jsonErr != nil {
-		log.Fatal(jsonErr)
+// e621UserAgent is userAgent with who to contact, as e621 asks
+func e621UserAgent(contact string) string {
+	if contact == "" {
+		return userAgent + " (+https://github.com/PawCorp/walltaker-desktop-client)"
 	}
-
-	return userData
+	return fmt.Sprintf("%s (by %s on e621)", userAgent, contact)
 }
 
 type NoDataError struct {
@@ -243,7 +99,7 @@ func (e *NoDataError) Error() string {
 	return e.Msg
 }
 
-func getWallpaperUrlFromData(userData WalltakerData) (string, error) {
+func getWallpaperUrlFromData(userData walltaker.Link) (string, error) {
 	if userData.PostURL.String == "" {
 		return "", &NoDataError{
 			Msg: fmt.Sprintf("No data found for ID %d", userData.ID),
@@ -252,192 +108,18 @@ func getWallpaperUrlFromData(userData WalltakerData) (string, error) {
 	return userData.PostURL.String, nil
 }
 
-func clearWindowsWallpaperCache() {
-	// Remove cached wallpaper files, issue #12
-	if runtime.GOOS == "windows" {
-		windowsWallpaperCacheDir := os.Getenv("APPDATA") + "\\Microsoft\\Windows\\Themes"
-		if _, err := os.Stat(windowsWallpaperCacheDir + "\\TranscodedWallpaper"); !os.IsNotExist(err) {
-			e := os.Remove(windowsWallpaperCacheDir + "\\TranscodedWallpaper")
-			if e != nil {
-				log.Fatal(e)
-			}
-		}
-		if _, err2 := os.Stat(windowsWallpaperCacheDir + "\\CachedFiles"); !os.IsNotExist(err2) {
-			e2 := os.RemoveAll(windowsWallpaperCacheDir + "\\CachedFiles")
-			if e2 != nil {
-				log.Fatal(e2)
-			}
-		}
-	}
-}
-
-func goSetWallpaper(url string, saveLocally bool, setterName string, setAt string, notify bool) {
-	clearWindowsWallpaperCache()
-	if runtime.GOOS != "windows" {
-		file, err := downloadImageForMac(url)
-		if err != nil {
-			log.Println("Ouch! Had a problem while downloading your wallpaper. This is a mac specific bug!")
-			log.Println("Full error: ", err)
-		}
-		wallpaper.SetFromFile(file)
-		defer cleanUpCacheForMac(file) // OK to delete after setting wallpaper, MacOS shows bg w/o file remaining there
-	} else {
-		err := wallpaper.SetFromURL(getImageUrlWithAppropriateSize(url))
-
-		if err != nil {
-			log.Println("Ouch! Had a problem while setting your wallpaper.")
-			log.Println("Full error: ", err)
-		}
-	}
-
-	if notify {
-		notifyStr := ""
-		if setterName == "" {
-			notifyStr = "Someone changed your wallpaper~"
-		} else {
-			notifyStr = fmt.Sprintf("%s changed your wallpaper~", setterName)
-		}
-		errNotify := beeep.Notify("Walltaker", notifyStr, "")
-		if errNotify != nil {
-			panic(errNotify)
-		}
-	}
-
-	if saveLocally {
-		saveWallpaperLocally(url, setterName, setAt)
-	}
-	return
-}
-
-func saveWallpaperLocally(url string, setterName string, setAt string) {
-	if setterName == "" {
-		setterName = "anonymous"
-	}
-
-	folderPath, err := osext.ExecutableFolder()
-	_, err = os.Stat(filepath.Join(folderPath, "download"))
-	if os.IsNotExist(err) {
-		log.Println("Created download directory since it did not exist")
-		os.Mkdir(filepath.Join(folderPath, "download"), os.FileMode(0777))
-	}
-
-	filename := filepath.Join(folderPath, "download", "walltaker_"+setterName+"_"+setAt+"_"+path.Base(url))
-	_, err = os.Stat(filename)
-
-	if os.IsNotExist(err) {
-
-		//log.Printf("Downloading", url, " to ", filename)
-		response, err := http.Get(url)
-		if err != nil {
-			return
-		}
-
-		defer response.Body.Close()
-
-		file, err := os.Create(filename)
-		if err != nil {
-			return
-		}
-		defer file.Close()
-		_, err = io.Copy(file, response.Body)
-	} else {
-		log.Printf("Wallpaper file already exists, skipping! ")
-	}
-	return
-}
-
-func openMyWtWebAppLink(base string, feed int64) {
-	browser.OpenURL(fmt.Sprintf("%s%d", base, feed))
+func openMyWtWebAppLink(feed int64) {
+	browser.OpenURL(walltakerClient.LinkURL(feed))
 }
 
 func openWtSetterPage(setterName string) {
 	if setterName != "" {
-		browser.OpenURL(fmt.Sprintf("https://walltaker.joi.how/users/%s", setterName))
-	}
-}
-
-func extractMD5(url string) string {
-	if url != "" {
-		md5str := url[strings.LastIndex(url, "/")+1:]
-		md5str = strings.Split(md5str, ".")[0]
-		return md5str
-	}
-	return ""
-}
-
-func formatE621SearchByMD5(md5 string) string {
-	return fmt.Sprintf("https://e621.net/posts?tags=md5%%3A%s", md5)
-}
-
-func formatE621APISearchByMD5(md5 string) string {
-	return fmt.Sprintf("https://e621.net/posts.json?tags=md5%%3A%s", md5)
-}
-
-func openE621(postUrl string) {
-	// extract md5 from post url
-	if postUrl != "" {
-		e621Posts := getE621Data(postUrl)
-		if len(e621Posts.Posts) > 0 {
-			browser.OpenURL(fmt.Sprintf("https://e621.net/posts/%d", e621Posts.Posts[0].ID))
-		}
-		// md5url := formatE621SearchByMD5(extractMD5(postUrl))
-		// browser.OpenURL(md5url)
-	}
-}
-
-func getE621Data(postUrl string) E621PostsData {
-	// extract md5 from post url
-	if postUrl != "" {
-		postsDataUrl := formatE621APISearchByMD5(extractMD5(postUrl))
-
-		// get json data from url
-		webClient := http.Client{
-			Timeout: time.Second * 2, // Timeout after 2 seconds
-		}
-
-		req, err := http.NewRequest(http.MethodGet, postsDataUrl, nil)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		req.Header.Set("User-Agent", "Walltaker Go Client/"+VERSION+"-"+runtime.GOOS)
-
-		res, getErr := webClient.Do(req)
-		if getErr != nil {
-			log.Fatal(getErr)
-		}
-
-		if res.Body != nil {
-			defer res.Body.Close()
-		}
-
-		body, readErr := ioutil.ReadAll(res.Body)
-		if readErr != nil {
-			log.Fatal(readErr)
-		}
-
-		postsData := E621PostsData{}
-		jsonErr := json.Unmarshal(body, &postsData)
-		if jsonErr != nil {
-			log.Fatal(jsonErr)
-		}
-		return postsData
+		browser.OpenURL(walltakerClient.UserURL(setterName))
 	}
-	return E621PostsData{}
 }
 
-func getImageUrlWithAppropriateSize(postUrl string) string {
-	if postUrl != "" {
-		postsData := getE621Data(postUrl)
-		if len(postsData.Posts) > 0 {
-			if postsData.Posts[0].File.Size > 17000000 {
-				return postsData.Posts[0].Sample.URL
-			} else {
-				return postsData.Posts[0].File.URL
-			}
-		}
-	}
-	return ""
+func getE621DataByMD5(md5 string) (e621.PostsData, error) {
+	return e621Client.PostsByMD5(rootCtx, md5)
 }
 
 func performVersionCheck() {
@@ -465,10 +147,11 @@ func performVersionCheck() {
 		log.Println("A new version of Walltaker is available!")
 		log.Println("Current:", VERSION, "Latest:", latestRelease.TagName)
 		log.Println("You can download it from ", "https://github.com/PawCorp/walltaker-desktop-client/releases/latest")
-		errNotify := beeep.Notify("Walltaker", "A new version of Walltaker is available! Please visit https://q.pawcorp.org/wtgo to download.", "")
-		if errNotify != nil {
-			panic(errNotify)
-		}
+		sendNotification(Notification{
+			Event: "update",
+			Title: "Walltaker",
+			Body:  "A new version of Walltaker is available! Please visit https://q.pawcorp.org/wtgo to download.",
+		})
 	}
 }
 
@@ -476,35 +159,61 @@ func main() {
 	// log to file
 	fn := logOutput()
 	defer fn()
-	// use file lock to determine if walltaker is already running
-	lockPath := "./walltaker.lock"
-	if runtime.GOOS == "darwin" {
-		lockPath = "/tmp/walltaker.lock"
+
+	loadState()
+	if runCommand(os.Args[1:]) {
+		return
 	}
-	lock := fslock.New(lockPath)
+
+	// use file lock to determine if walltaker is already running
+	lock := instanceLock()
 	err := lock.TryLock()
 	if err != nil {
 		log.Println(err.Error())
-		errNotify := beeep.Notify("Walltaker", "Note: Walltaker is already running!", "")
-		if errNotify != nil {
-			panic(errNotify)
-		}
+		sendNotification(Notification{
+			Event: "error",
+			Title: "Walltaker",
+			Body:  "Note: Walltaker is already running!",
+		})
 		return
 	}
 
-	bg, err := wallpaper.Get()
+	bg, err := wallpapers.Backend.Get()
 	if err != nil {
 		panic(err)
 	}
 	log.Println("Detected original wallpaper as: ", bg)
+	rememberOriginalWallpaper(bg)
+	startSession()
 
 	defer lock.Unlock()
-	onExit := func() {
-		log.Println("Reverting wallpaper to: ", bg)
-		wallpaper.SetFromFile(bg)
+	handleExitSignals()
+	systray.Run(onReady, shutdown)
+}
+
+// instanceLock is held by the running tray app
+func instanceLock() *fslock.Lock {
+	lockPath := "./walltaker.lock"
+	if runtime.GOOS == "darwin" {
+		lockPath = "/tmp/walltaker.lock"
+	}
+	return fslock.New(lockPath)
+}
+
+// loadConfig reads walltaker.toml from next to the executable
+func loadConfig() (config.Config, error) {
+	folderPath, err := osext.ExecutableFolder()
+	if err != nil {
+		return config.Config{}, err
+	}
+
+	cfg, err := config.Load(folderPath)
+	if err != nil {
+		return cfg, err
 	}
 
-	systray.Run(onReady, onExit)
+	log.Println("Loaded config from " + filepath.Join(folderPath, config.FileName))
+	return cfg, nil
 }
 
 func onReady() {
@@ -522,205 +231,236 @@ func onReady() {
 
 	(You can minimize this window; it will periodically check in for new wallpapers)
 	`)
-	performVersionCheck()
 	start := time.Now()
 
-	folderPath, err := osext.ExecutableFolder()
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	dat, err := os.ReadFile(filepath.Join(folderPath, "walltaker.toml"))
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	log.Println("Loaded config from " + filepath.Join(folderPath, "walltaker.toml"))
-
-	tomlDat := string(dat)
-
-	config, _ := toml.Load(tomlDat)
-
 	defer func() {
 		if r := recover(); r != nil {
+			log.Println(r)
 			log.Println("Ensure your .toml file is up to date!")
-			errNotify := beeep.Notify("Walltaker", "Could not launch Walltaker! Ensure your .toml file is up to date.", "")
-			if errNotify != nil {
-				panic(errNotify)
-			}
+			sendNotification(Notification{
+				Event: "error",
+				Title: "Walltaker",
+				Body:  "Could not launch Walltaker! Ensure your .toml file is up to date.",
+			})
 			systray.Quit()
 		}
 	}()
 
-	// store crop bool
-	crop := true // true before read in by config
-
-	base := config.Get("Base.base").(string)
-	feed := config.Get("Feed.feed").(int64)
-	mode := config.Get("Preferences.mode").(string)
-	saveLocally = config.Get("Preferences.saveLocally").(bool)
-	useDiscord := config.Get("Preferences.discordPresence").(bool)
-	notifications = config.Get("Preferences.notifications").(bool)
-
-	if strings.ToLower(mode) == "fit" {
-		crop = false
-	} else if strings.ToLower(mode) == "crop" {
-		crop = true
-	} else {
-		crop = true
+	cfg, err := loadConfig()
+	if err != nil {
+		panic(err)
 	}
 
-	builtUrl := base + strconv.FormatInt(feed, 10) + ".json"
-
-	timeNow := time.Now() // start time for discord purposes
-	if useDiscord == true {
-		discorderr := client.Login("942796233033019504")
-		if discorderr != nil {
-			log.Fatal(discorderr)
-		}
-
-		discorderr = client.SetActivity(client.Activity{
-			State: "Set my wallpaper~",
-			// Details:    strings.Replace(builtUrl, ".json", "", -1),
-			Details:    fmt.Sprintf("https://wt.pawcorp.org/%d", feed),
-			LargeImage: "eggplant",
-			LargeText:  "Powered by joi.how",
-			Timestamps: &client.Timestamps{
-				Start: &timeNow,
-			},
-		})
+	configureClients(cfg)
+	if dir, err := walltakerDir(); err == nil {
+		wallpapers.Dir = dir
+	}
+	app.SetFeed(cfg.Feed)
+	settings := app.Settings()
+	settings.Crop = cfg.Crop()
+	settings.SaveLocally = cfg.SaveLocally
+	settings.DiscordPresence = cfg.DiscordPresence
+	settings.Notifications = cfg.Notifications
+	presence.configure(presenceConfig(cfg.Presence))
+	saveDirectory = cfg.SaveDirectory
+	saveFilenameTemplate = cfg.SaveFilename
+	dedupSimilar = cfg.DedupSimilar
+	notificationTitle = cfg.NotificationTitle
+	notificationBody = cfg.NotificationBody
+	notificationThumbnails = cfg.NotificationThumbnail
+	loadNotifiers(cfg.Tree)
+	performVersionCheck()
+	app.UpdateSettings(func(s *flow.Settings) {
+		*s = settings
+	})
 
-		if discorderr != nil {
-			log.Fatal(discorderr)
-		}
-	}
+	app.Subscribe(logAppEvent)
+	followConnection()
+	presence.follow(app)
+	presence.sync()
 
-	if saveLocally == true {
+	if settings.SaveLocally {
 		log.Println("Local saving enabled")
-		_, err := os.Stat(filepath.Join(folderPath, "download"))
-		if os.IsNotExist(err) {
-			log.Println("Created download directory since it did not exist")
-			os.Mkdir(filepath.Join(folderPath, "download"), os.FileMode(0777))
+		saveDir, err := resolveSaveDirectory()
+		if err != nil {
+			log.Println("Could not create save directory: ", err)
+		} else {
+			log.Println("Saving wallpapers to ", saveDir)
 		}
 	}
 
 	systray.SetTemplateIcon(icon.Data, icon.Data)
 	systray.SetTitle("Walltaker")
 	systray.SetTooltip("Walltaker")
+	menuAppSetBy := systray.AddMenuItem("-", "Who sent your most recent wallpaper~")
+	app.Subscribe(func(event flow.AppEvent) {
+		if event.Kind == flow.EventPost {
+			setBy := event.Post.SetBy.String
+			if setBy == "" {
+				setBy = "Anonymous"
+			}
+			menuAppSetBy.SetTitle(fmt.Sprintf("Set by %s", setBy))
+		}
+	})
 	menuAppTimer := systray.AddMenuItem("Elapsed: 0", "Time since Walltaker started")
 	menuAppTimer.SetIcon(icon.Data)
 	menuAppTimer.Disabled()
-	// menuAppSetBy := systray.AddMenuItem("-", "Who sent your most recent wallpaper~") // moved to global
-	menuE621 := systray.AddMenuItem("Open e621", "Open image on e621")
+	menuExpiry := systray.AddMenuItem("Expires: -", "Time left until your link expires")
+	menuExpiry.Disable()
+	menuOffline := systray.AddMenuItem("Offline", "Can't reach Walltaker, showing your last wallpaper until it's back")
+	menuOffline.Disable()
+	menuOffline.Hide()
+	app.Subscribe(func(event flow.AppEvent) {
+		if event.Kind != flow.EventOffline {
+			return
+		}
+		if event.Offline {
+			menuOffline.Show()
+			systray.SetTooltip("Walltaker (offline)")
+		} else {
+			menuOffline.Hide()
+			systray.SetTooltip("Walltaker")
+		}
+	})
+	menuSource := systray.AddMenuItem("Open Source Page", "Open the post where it came from, e.g. e621")
+	app.Subscribe(func(event flow.AppEvent) {
+		if event.Kind == flow.EventPost {
+			menuSource.SetTooltip("Open the post on " + sourceFor(event.Post.PostURL.String).Name())
+		}
+	})
+	addReactMenu()
+	addLinkInfoMenu()
 	// menuAppSetBy.Disabled()
-	setterName = ""
-
-	u, _ := url.Parse("wss://walltaker.joi.how/cable")
-	consumer, _ := actioncable.CreateConsumer(u, nil)
-	consumer.Connect()
 
-	params := map[string]interface{}{
-		"id": feed,
-	}
-
-	id := actioncable.NewChannelIdentifier("LinkChannel", params)
-	subscription, subErr := consumer.Subscriptions.Create(id)
-	if subErr != nil {
-		log.Fatal("Failed to subscribe")
-	}
-	subscription.SetHandler(&LinkSubscriptionEventHandler{})
+	watchFeed(app.Feed())
 
 	// timer loop
 	go func() {
-		for range time.Tick(time.Second) {
+		for sleepCtx(rootCtx, time.Second) {
 			elapsed := time.Since(start)
 			menuAppTimer.SetTitle(fmt.Sprintf("Elapsed: %s", elapsed.Round(time.Second)))
 		}
 	}()
 
+	go newExpiryWatcher(cfg.Expiry, menuExpiry.SetTitle).run(rootCtx)
+
+	handleSafeModeSignal()
+	if cfg.DashboardEnabled {
+		go serveDashboard(cfg.DashboardPort)
+	}
+	if cfg.ScreenShareDetection {
+		go watchForScreenShare(cfg.ScreenShareProcesses)
+	}
+
 	// wallpaper loop
+	wallpapers.Follow()
+
 	go func() {
-		bg, err := wallpaper.Get()
-		if err != nil {
-			panic(err)
+		settings := app.Settings()
+		menuOpenMyWtWebAppLink := systray.AddMenuItem(fmt.Sprintf("Open my Walltaker Page (%d)", app.Feed()), "Opens your link in a web browser")
+		systray.AddSeparator()
+		menuCropImages := systray.AddMenuItemCheckbox("Crop", "Crop images to fill the whole screen", settings.Crop)
+		menuSaveImages := systray.AddMenuItemCheckbox("Save Images", "Check to save images to disk", settings.SaveLocally)
+		menuDiscordPresence := systray.AddMenuItemCheckbox("Discord Presence", "Let your friends know what you're up to~", settings.DiscordPresence)
+		presence.watchStatus(func(status string) {
+			menuDiscordPresence.SetTooltip("Let your friends know what you're up to~ (" + status + ")")
+		})
+		menuNotifications := systray.AddMenuItemCheckbox("Notifications", "Get a desktop notification for new wallpapers, in case you've got something maximized", settings.Notifications)
+		menuSafeMode := systray.AddMenuItemCheckbox("Safe Mode", "Restore your original wallpaper and pause Walltaker while screen sharing or presenting", settings.SafeMode)
+		menuSetID := systray.AddMenuItem("Set ID", "Change which IDs wallpaper feed to use")
+		menuSetOther := systray.AddMenuItem("Set Someone's Wallpaper", "Set the wallpaper of a link to an e621 post (needs your API key)")
+		menuAPIKey := systray.AddMenuItem("Set API Key", "Your Walltaker API key, for setting wallpapers and responding")
+		menuDashboard := systray.AddMenuItem("Open Dashboard", "Open the Walltaker dashboard in your browser")
+		if !cfg.DashboardEnabled {
+			menuDashboard.Hide()
 		}
-		log.Println("Detected original wallpaper as: ", bg)
-
-		c := make(chan os.Signal)
-		signal.Notify(c, os.Interrupt)
-		go func() {
-			<-c
-			wallpaper.SetFromFile(bg)
-			os.Exit(0)
-		}()
-
-		userData := getWalltakerData(builtUrl)
-
-		wallpaperUrl, noDataErr := getWallpaperUrlFromData(userData)
-		ready := noDataErr == nil
-		for ready == false {
-			if noDataErr != nil {
-				// log.Fatal(noDataErr)
-				time.Sleep(time.Second * time.Duration(5))
-				builtUrl = base + strconv.FormatInt(feed, 10) + ".json" // account for runtime change of poll ID
-				userData = getWalltakerData(builtUrl)
-				wallpaperUrl, noDataErr = getWallpaperUrlFromData(userData)
-			} else {
-				ready = true
+
+		systray.AddSeparator()
+		mQuit := systray.AddMenuItem("QUIT", "Quit the whole app")
+
+		systray.AddSeparator()
+
+		// keep the tray in step with changes from the dashboard, signals and
+		// the screen share watcher as well as clicks
+		app.Subscribe(func(event flow.AppEvent) {
+			switch event.Kind {
+			case flow.EventSettings:
+				setChecked(menuCropImages, event.Settings.Crop)
+				setChecked(menuSaveImages, event.Settings.SaveLocally)
+				setChecked(menuDiscordPresence, event.Settings.DiscordPresence)
+				setChecked(menuNotifications, event.Settings.Notifications)
+				setChecked(menuSafeMode, event.Settings.SafeMode)
+			case flow.EventFeed:
+				menuOpenMyWtWebAppLink.SetTitle(fmt.Sprintf("Open my Walltaker Page (%d)", event.Feed))
 			}
-		}
+		})
 
-		setterName = userData.SetBy.String
-		setAt := strings.ReplaceAll(time.Now().Format(time.RFC3339), ":", "-")
-		if setterName != "" {
-			log.Printf(setterName)
-			log.Printf(" set your initial wallpaper: Setting... ")
-			menuAppSetBy.SetTitle(fmt.Sprintf("Set by %s", setterName))
-		} else {
-			log.Printf("Anonymous set your initial wallpaper: Setting... ")
-			menuAppSetBy.SetTitle(fmt.Sprintf("Set by %s", "Anonymous"))
+		setSafeMode := func(on bool) {
+			if on == app.Settings().SafeMode {
+				return
+			}
+			app.UpdateSettings(func(s *flow.Settings) {
+				s.SafeMode = on
+			})
+			if on {
+				// through the queue, so a post still downloading can't
+				// land on top of it
+				wallpapers.QueueRestore()
+			} else if current := app.CurrentPost(); current.PostURL.String != "" {
+				// catch up on whatever was sent while we were hiding
+				setAt := strings.ReplaceAll(time.Now().Format(time.RFC3339), ":", "-")
+				wallpapers.Queue.Enqueue(flow.Update{Post: current, SetAt: setAt, Record: true})
+			}
 		}
-		goSetWallpaper(wallpaperUrl, saveLocally, setterName, setAt, notifications)
 
-		log.Printf("Set!")
-
-		if !crop {
-			err = wallpaper.SetMode(wallpaper.Fit)
-		} else if crop {
-			err = wallpaper.SetMode(wallpaper.Crop)
-		} else {
-			err = wallpaper.SetMode(wallpaper.Crop)
+		switchFeed := func(newFeed int64) {
+			app.SetFeed(newFeed)
+			watchFeed(newFeed)
+			wallpapers.Follow()
+			log.Println("Set new Walltaker poll ID")
 		}
 
-		pref.setOldWallpaperUrl(wallpaperUrl)
-	}()
+		setCrop := func(on bool) {
+			wallpapers.SetMode(on)
+			app.UpdateSettings(func(s *flow.Settings) {
+				s.Crop = on
+			})
+		}
 
-	go func() {
-		menuOpenMyWtWebAppLink := systray.AddMenuItem(fmt.Sprintf("Open my Walltaker Page (%d)", feed), "Opens your link in a web browser")
-		systray.AddSeparator()
-		menuCropImages := systray.AddMenuItemCheckbox("Crop", "Crop images to fill the whole screen", crop)
-		menuSaveImages := systray.AddMenuItemCheckbox("Save Images", "Check to save images to disk", saveLocally)
-		menuDiscordPresence := systray.AddMenuItemCheckbox("Discord Presence", "Let your friends know what you're up to~", useDiscord)
-		menuNotifications := systray.AddMenuItemCheckbox("Notifications", "Get a desktop notification for new wallpapers, in case you've got something maximized", notifications)
-		menuSetID := systray.AddMenuItem("Set ID", "Change which IDs wallpaper feed to use")
+		setSaveLocally := func(on bool) {
+			app.UpdateSettings(func(s *flow.Settings) {
+				s.SaveLocally = on
+			})
+		}
 
-		systray.AddSeparator()
-		mQuit := systray.AddMenuItem("QUIT", "Quit the whole app")
+		setDiscordPresence := func(on bool) {
+			settings := app.UpdateSettings(func(s *flow.Settings) {
+				s.DiscordPresence = on
+			})
+			if settings.SafeMode {
+				log.Println("Safe mode is on, Discord Presence will update when it is turned off")
+			}
+		}
 
-		systray.AddSeparator()
+		setNotifications := func(on bool) {
+			app.UpdateSettings(func(s *flow.Settings) {
+				s.Notifications = on
+			})
+		}
 
 		for {
 			select {
-			case <-menuE621.ClickedCh:
-				openE621(pref.oldWallpaperUrl)
+			case <-menuSource.ClickedCh:
+				openSourcePage(app.CurrentPost().PostURL.String)
 			case <-menuAppSetBy.ClickedCh:
-				openWtSetterPage(setterName)
+				openWtSetterPage(app.SetterName())
 			case <-menuOpenMyWtWebAppLink.ClickedCh:
-				openMyWtWebAppLink(base, feed)
+				openMyWtWebAppLink(app.Feed())
 			case <-menuSetID.ClickedCh:
 				getInputText := "Enter a Walltaker ID to poll"
 				for {
 					var i int
+					var err error
 					got, ok := inputbox.InputBox("Change active Walltaker ID", getInputText, "0")
 					if ok {
 						log.Println("you entered:", got)
@@ -728,7 +468,7 @@ func onReady() {
 						log.Println("No value entered")
 					}
 					if got == "" {
-						log.Println(fmt.Sprintf("No value entered; keeping old value of %d", feed))
+						log.Println(fmt.Sprintf("No value entered; keeping old value of %d", app.Feed()))
 						break
 					}
 					i, err = strconv.Atoi(got)
@@ -737,133 +477,43 @@ func onReady() {
 						getInputText = "Enter a Walltaker ID to poll (you entered something that was not a number last time; try again)"
 					} else {
 						log.Println("Got: " + strconv.Itoa(i))
-						feed = int64(i)
-						subscription.Unsubscribe() // unsubscribe from previous channel
-						params := map[string]interface{}{
-							"id": feed,
-						}
-
-						id := actioncable.NewChannelIdentifier("LinkChannel", params)
-						subscription, subErr := consumer.Subscriptions.Create(id)
-						if subErr != nil {
-							log.Fatal("Failed to subscribe")
-						}
-						subscription.SetHandler(&LinkSubscriptionEventHandler{})
-						builtUrl := base + strconv.FormatInt(feed, 10) + ".json"
-						userData := getWalltakerData(builtUrl)
-
-						wallpaperUrl, noDataErr := getWallpaperUrlFromData(userData)
-						ready := noDataErr == nil
-						for ready == false {
-							if noDataErr != nil {
-								// log.Fatal(noDataErr)
-								time.Sleep(time.Second * time.Duration(5))
-								builtUrl = base + strconv.FormatInt(feed, 10) + ".json" // account for runtime change of poll ID
-								userData = getWalltakerData(builtUrl)
-								wallpaperUrl, noDataErr = getWallpaperUrlFromData(userData)
-							} else {
-								ready = true
-							}
-						}
-
-						setterName = userData.SetBy.String
-						setAt := strings.ReplaceAll(time.Now().Format(time.RFC3339), ":", "-")
-						if setterName != "" {
-							log.Printf(setterName)
-							log.Printf(" set your initial wallpaper: Setting... ")
-							menuAppSetBy.SetTitle(fmt.Sprintf("Set by %s", setterName))
-						} else {
-							log.Printf("Anonymous set your initial wallpaper: Setting... ")
-							menuAppSetBy.SetTitle(fmt.Sprintf("Set by %s", "Anonymous"))
-						}
-						goSetWallpaper(wallpaperUrl, saveLocally, setterName, setAt, notifications)
-
-						log.Printf("Set!")
-
-						if !crop {
-							err = wallpaper.SetMode(wallpaper.Fit)
-						} else if crop {
-							err = wallpaper.SetMode(wallpaper.Crop)
-						} else {
-							err = wallpaper.SetMode(wallpaper.Crop)
-						}
-
-						pref.setOldWallpaperUrl(wallpaperUrl)
-						if useDiscord == true {
-							discorderr := client.SetActivity(client.Activity{
-								State: "Set my wallpaper~",
-								// Details:    base + strconv.FormatInt(feed, 10),
-								Details:    fmt.Sprintf("https://wt.pawcorp.org/%d", feed),
-								LargeImage: "eggplant",
-								LargeText:  "Powered by joi.how",
-								Timestamps: &client.Timestamps{
-									Start: &timeNow,
-								},
-							})
-
-							if discorderr != nil {
-								log.Fatal(discorderr)
-							}
-						}
-						menuOpenMyWtWebAppLink.SetTitle(fmt.Sprintf("Open my Walltaker Page (%d)", feed))
-						log.Println("Set new Walltaker poll ID")
+						switchFeed(int64(i))
 						break
 					}
 				}
 			case <-menuCropImages.ClickedCh:
-				if menuCropImages.Checked() {
-					menuCropImages.Uncheck()
-					err = wallpaper.SetMode(wallpaper.Fit)
-				} else {
-					menuCropImages.Check()
-					err = wallpaper.SetMode(wallpaper.Crop)
-				}
-				crop = !crop
+				setCrop(!app.Settings().Crop)
 			case <-menuSaveImages.ClickedCh:
-				if menuSaveImages.Checked() {
-					menuSaveImages.Uncheck()
-				} else {
-					menuSaveImages.Check()
-				}
-				saveLocally = !saveLocally
-				log.Println(fmt.Sprintf("Changed saveLocally to %t", saveLocally))
+				setSaveLocally(!app.Settings().SaveLocally)
 			case <-menuDiscordPresence.ClickedCh:
-				if menuDiscordPresence.Checked() {
-					menuDiscordPresence.Uncheck()
-					client.Logout()
-					log.Println("Stopped Discord Presence")
-				} else {
-					menuDiscordPresence.Check()
-					discorderr := client.Login("942796233033019504")
-					if discorderr != nil {
-						log.Fatal(discorderr)
-					}
-
-					discorderr = client.SetActivity(client.Activity{
-						State: "Set my wallpaper~",
-						// Details:    strings.Replace(builtUrl, ".json", "", -1),
-						Details:    fmt.Sprintf("https://wt.pawcorp.org/%d", feed),
-						LargeImage: "eggplant",
-						LargeText:  "Powered by joi.how",
-						Timestamps: &client.Timestamps{
-							Start: &timeNow,
-						},
-					})
-
-					if discorderr != nil {
-						log.Fatal(discorderr)
-					}
-					log.Println("Started Discord Presence")
-				}
-				useDiscord = !useDiscord
+				setDiscordPresence(!app.Settings().DiscordPresence)
 			case <-menuNotifications.ClickedCh:
-				if menuNotifications.Checked() {
-					menuNotifications.Uncheck()
-				} else {
-					menuNotifications.Check()
+				setNotifications(!app.Settings().Notifications)
+			case <-menuSetOther.ClickedCh:
+				go setOtherWallpaperFromTray()
+			case <-menuAPIKey.ClickedCh:
+				go setAPIKeyFromTray()
+			case <-menuDashboard.ClickedCh:
+				openDashboard(cfg.DashboardPort)
+			case req := <-settingRequests:
+				switch req.Setting {
+				case "crop":
+					setCrop(req.Enabled)
+				case "saveLocally":
+					setSaveLocally(req.Enabled)
+				case "discordPresence":
+					setDiscordPresence(req.Enabled)
+				case "notifications":
+					setNotifications(req.Enabled)
+				case "safeMode":
+					setSafeMode(req.Enabled)
+				case "link":
+					switchFeed(req.LinkID)
 				}
-				notifications = !notifications
-				log.Println(fmt.Sprintf("notifications set to %t", notifications))
+			case <-menuSafeMode.ClickedCh:
+				setSafeMode(!app.Settings().SafeMode)
+			case on := <-safeModeRequests:
+				setSafeMode(on)
 			case <-mQuit.ClickedCh:
 				systray.Quit()
 				log.Println("Quit now...")
@@ -873,20 +523,88 @@ func onReady() {
 	}()
 }
 
+// watchFeed follows link feed live. If that fails the user is told and we're
+// offline, trying again every minute until it works or another link is
+// watched.
+func watchFeed(feed int64) {
+	err := wallpapers.Watch(feed)
+	if err == nil {
+		return
+	}
+	log.Println("Could not follow link ", feed, ": ", err)
+	sendNotification(Notification{
+		Event:  "error",
+		Title:  "Walltaker",
+		Body:   "Could not connect to Walltaker, trying again in the background",
+		LinkID: int(feed),
+	})
+	goOffline()
+	go func() {
+		for sleepCtx(rootCtx, time.Minute) {
+			if app.Feed() != feed {
+				return
+			}
+			err := wallpapers.Watch(feed)
+			if err == nil {
+				log.Println("Following link ", feed, " again")
+				return
+			}
+			log.Println("Could not follow link ", feed, ": ", err)
+		}
+	}()
+}
+
+// setOtherWallpaperFromTray asks for a link and a post, and sets the link
+func setOtherWallpaperFromTray() {
+	got, ok := inputbox.InputBox("Set Someone's Wallpaper", "Enter the Walltaker link ID to set", "")
+	if !ok || strings.TrimSpace(got) == "" {
+		return
+	}
+	linkID, err := strconv.ParseInt(strings.TrimSpace(got), 10, 64)
+	if err != nil {
+		notifyActionResult("", fmt.Errorf("%q is not a link ID", got))
+		return
+	}
+	got, ok = inputbox.InputBox("Set Someone's Wallpaper", fmt.Sprintf("Enter the e621 post ID or URL to set link %d to", linkID), "")
+	if !ok || strings.TrimSpace(got) == "" {
+		return
+	}
+	postID, err := parsePostID(got)
+	if err == nil {
+		err = setLinkPost(linkID, postID)
+	}
+	notifyActionResult(fmt.Sprintf("Set link %d to post %d~", linkID, postID), err)
+}
+
+// setAPIKeyFromTray asks for the API key and stores it
+func setAPIKeyFromTray() {
+	got, ok := inputbox.InputBox("Set API Key", "Enter your Walltaker API key (from your dashboard on walltaker.joi.how)", "")
+	key := strings.TrimSpace(got)
+	if !ok || key == "" {
+		return
+	}
+	where, err := storeAPIKey(key)
+	if err == nil {
+		setAPIKey(key)
+	}
+	notifyActionResult("Stored your API key in "+where, err)
+}
+
+func setChecked(item *systray.MenuItem, checked bool) {
+	if checked {
+		item.Check()
+	} else {
+		item.Uncheck()
+	}
+}
+
 func logOutput() func() {
 	// modified from https://gist.github.com/jerblack/4b98ba48ed3fb1d9f7544d2b1a1be287
-	cacheDir, err := os.UserCacheDir()
+	wtCacheDir, err := walltakerDir()
 	if err != nil {
 		panic(err)
 	}
-	wtCacheDir := filepath.Join(cacheDir, ".walltaker")
 	wtCacheLogsDir := filepath.Join(wtCacheDir, "logs")
-	if _, err := os.Stat(wtCacheDir); os.IsNotExist(err) {
-		err := os.Mkdir(wtCacheDir, os.FileMode(0777))
-		if err != nil {
-			panic(err)
-		}
-	}
 	if _, err := os.Stat(wtCacheLogsDir); os.IsNotExist(err) {
 		err := os.Mkdir(wtCacheLogsDir, os.FileMode(0777))
 		if err != nil {
@@ -904,6 +622,7 @@ func logOutput() func() {
 	// log.Println("This is a test log entry")
 	return func() {
 		// close file after all writes have finished
+		_ = f.Sync()
 		_ = f.Close()
 	}
 }
@@ -0,0 +1,333 @@
+package walltaker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// staleAfter is how long the cable waits for any message, Walltaker
+	// pings every few seconds
+	staleAfter = 6 * time.Second
+	// retryMin and retryMax bound the wait between connection attempts
+	retryMin = 100 * time.Millisecond
+	retryMax = 5 * time.Second
+)
+
+// Handler gets the events of a subscription. Funcs left nil are skipped.
+// They run on the cable's own goroutine, one at a time, so they should not
+// block.
+type Handler struct {
+	// Update gets the link every time it changes
+	Update       func(link Link)
+	Connected    func()
+	Disconnected func()
+	Rejected     func()
+}
+
+// Cable is a connection to Walltaker's ActionCable endpoint, which pushes
+// links to whoever subscribed to them as they change. It connects in the
+// background and reconnects by itself until ctx given to Connect is done.
+type Cable struct {
+	url    string
+	header http.Header
+
+	mu            sync.Mutex
+	subscriptions map[string]*Subscription // by identifier
+	// ws is the open connection, set once Walltaker welcomed it
+	ws *websocket.Conn
+	// writeMu keeps to one writer at a time, as gorilla/websocket needs
+	writeMu sync.Mutex
+}
+
+// Connect opens a Cable. It returns right away, without waiting for
+// Walltaker; subscriptions are sent once it answers. It's closed when ctx is
+// done.
+func (c *Client) Connect(ctx context.Context) (*Cable, error) {
+	u, err := c.CableURL()
+	if err != nil {
+		return nil, err
+	}
+	cable := &Cable{
+		url:           u.String(),
+		header:        http.Header{"User-Agent": {c.UserAgent}},
+		subscriptions: map[string]*Subscription{},
+	}
+	go cable.run(ctx)
+	return cable, nil
+}
+
+// run connects and reads until ctx is done, waiting longer between every
+// failed attempt
+func (cable *Cable) run(ctx context.Context) {
+	retry := retryMin
+	for ctx.Err() == nil {
+		welcomed, err := cable.connectOnce(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Println("Walltaker cable: ", err)
+		if welcomed {
+			retry = retryMin
+		}
+		timer := time.NewTimer(retry)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		retry *= 3
+		if retry > retryMax {
+			retry = retryMax
+		}
+	}
+}
+
+// cableMessage is anything ActionCable sends
+type cableMessage struct {
+	Type       string          `json:"type"`
+	Identifier string          `json:"identifier"`
+	Message    json.RawMessage `json:"message"`
+}
+
+// connectOnce holds one connection until it fails or ctx is done, and
+// reports whether Walltaker welcomed it
+func (cable *Cable) connectOnce(ctx context.Context) (bool, error) {
+	// gorilla/websocket stops watching ctx once the TCP connection is up,
+	// so close it ourselves, which also ends a stuck handshake or read
+	dialed := make(chan net.Conn, 1)
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case conn := <-dialed:
+			select {
+			case <-ctx.Done():
+				conn.Close()
+			case <-finished:
+			}
+		case <-finished:
+		}
+	}()
+	dialer := websocket.Dialer{
+		HandshakeTimeout: 10 * time.Second,
+		NetDialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+			if err == nil {
+				select {
+				case dialed <- conn:
+				default:
+				}
+			}
+			return conn, err
+		},
+	}
+	ws, _, err := dialer.DialContext(ctx, cable.url, cable.header)
+	if err != nil {
+		return false, err
+	}
+	defer ws.Close()
+
+	welcomed := false
+	defer func() {
+		if welcomed {
+			cable.disconnected()
+		}
+	}()
+	for {
+		ws.SetReadDeadline(time.Now().Add(staleAfter))
+		var message cableMessage
+		err := ws.ReadJSON(&message)
+		if err != nil {
+			return welcomed, err
+		}
+		switch message.Type {
+		case "welcome":
+			welcomed = true
+			cable.welcome(ws)
+		case "ping":
+		case "confirm_subscription":
+			if s := cable.subscription(message.Identifier); s != nil && s.handler.Connected != nil {
+				s.handler.Connected()
+			}
+		case "reject_subscription":
+			if s := cable.subscription(message.Identifier); s != nil {
+				cable.forget(s)
+				if s.handler.Rejected != nil {
+					s.handler.Rejected()
+				}
+			}
+		case "disconnect":
+			return welcomed, errors.New("disconnected by Walltaker")
+		default:
+			s := cable.subscription(message.Identifier)
+			if s == nil || s.handler.Update == nil {
+				continue
+			}
+			link := Link{}
+			if json.Unmarshal(message.Message, &link) == nil {
+				s.handler.Update(link)
+			}
+		}
+	}
+}
+
+// welcome makes ws the cable's connection and subscribes everything on it
+func (cable *Cable) welcome(ws *websocket.Conn) {
+	cable.mu.Lock()
+	cable.ws = ws
+	var identifiers []string
+	for identifier := range cable.subscriptions {
+		identifiers = append(identifiers, identifier)
+	}
+	cable.mu.Unlock()
+	for _, identifier := range identifiers {
+		cable.send(ws, "subscribe", identifier)
+	}
+}
+
+// disconnected tells every subscription the connection is gone
+func (cable *Cable) disconnected() {
+	cable.mu.Lock()
+	cable.ws = nil
+	var subscriptions []*Subscription
+	for _, s := range cable.subscriptions {
+		subscriptions = append(subscriptions, s)
+	}
+	cable.mu.Unlock()
+	for _, s := range subscriptions {
+		if s.handler.Disconnected != nil {
+			s.handler.Disconnected()
+		}
+	}
+}
+
+func (cable *Cable) subscription(identifier string) *Subscription {
+	cable.mu.Lock()
+	defer cable.mu.Unlock()
+	return cable.subscriptions[identifier]
+}
+
+// forget drops s, unless it was replaced by a new subscription to the same
+// link
+func (cable *Cable) forget(s *Subscription) {
+	cable.mu.Lock()
+	defer cable.mu.Unlock()
+	if cable.subscriptions[s.identifier] == s {
+		delete(cable.subscriptions, s.identifier)
+	}
+}
+
+// send writes a command on ws, if there is a connection
+func (cable *Cable) send(ws *websocket.Conn, command string, identifier string) {
+	if ws == nil {
+		return
+	}
+	cable.writeMu.Lock()
+	defer cable.writeMu.Unlock()
+	ws.SetWriteDeadline(time.Now().Add(staleAfter))
+	err := ws.WriteJSON(map[string]string{
+		"command":    command,
+		"identifier": identifier,
+	})
+	if err != nil {
+		// the read fails too and reconnects, subscribing again
+		log.Println("Walltaker cable: ", err)
+	}
+}
+
+// Subscription is one link being followed on a Cable
+type Subscription struct {
+	ID         int64
+	cable      *Cable
+	identifier string
+	handler    Handler
+	once       sync.Once
+}
+
+// Subscribe follows link id, calling handler until Unsubscribe. If the cable
+// isn't connected yet it subscribes once it is.
+func (cable *Cable) Subscribe(id int64, handler Handler) (*Subscription, error) {
+	identifier, err := json.Marshal(map[string]interface{}{
+		"channel": "LinkChannel",
+		"id":      id,
+	})
+	if err != nil {
+		return nil, err
+	}
+	s := &Subscription{ID: id, cable: cable, identifier: string(identifier), handler: handler}
+	cable.mu.Lock()
+	cable.subscriptions[s.identifier] = s
+	ws := cable.ws
+	cable.mu.Unlock()
+	cable.send(ws, "subscribe", s.identifier)
+	return s, nil
+}
+
+// Unsubscribe stops following the link. An update being handled right now
+// still finishes. Calling it again does nothing.
+func (s *Subscription) Unsubscribe() {
+	s.once.Do(func() {
+		s.cable.mu.Lock()
+		current := s.cable.subscriptions[s.identifier] == s
+		if current {
+			delete(s.cable.subscriptions, s.identifier)
+		}
+		ws := s.cable.ws
+		s.cable.mu.Unlock()
+		if current {
+			s.cable.send(ws, "unsubscribe", s.identifier)
+		}
+	})
+}
+
+// Updates is the short way to follow one link: it connects, subscribes to
+// id and sends every update on the channel, until ctx is done and the
+// channel is closed. While the reader is busy only the newest update is
+// kept, older ones are dropped.
+func (c *Client) Updates(ctx context.Context, id int64) (<-chan Link, error) {
+	cable, err := c.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	updates := make(chan Link, 1)
+	var mu sync.Mutex
+	closed := false
+	subscription, err := cable.Subscribe(id, Handler{
+		Update: func(link Link) {
+			mu.Lock()
+			defer mu.Unlock()
+			if closed {
+				return
+			}
+			// replace an update the reader hasn't taken yet; only this
+			// sends, under mu, so the slot is free afterwards
+			select {
+			case <-updates:
+			default:
+			}
+			updates <- link
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		<-ctx.Done()
+		subscription.Unsubscribe()
+		mu.Lock()
+		closed = true
+		close(updates)
+		mu.Unlock()
+	}()
+	return updates, nil
+}
@@ -0,0 +1,8 @@
+module github.com/PawCorp/walltaker-desktop-client/walltaker
+
+go 1.18
+
+require (
+	github.com/gorilla/websocket v1.5.0
+	github.com/guregu/null v4.0.0+incompatible
+)
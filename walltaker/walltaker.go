@@ -0,0 +1,212 @@
+// Package walltaker is a client for the Walltaker API at
+// https://walltaker.joi.how, where friends set each other's wallpapers.
+//
+// It's versioned on its own, separately from the desktop client, with tags
+// like walltaker/v0.1.0.
+package walltaker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/guregu/null"
+)
+
+const DefaultBaseURL = "https://walltaker.joi.how"
+
+// Link is a Walltaker link: somebody's wallpaper, and who set it to what
+type Link struct {
+	ID               int         `json:"id"`
+	Expires          time.Time   `json:"expires"`
+	UserID           int         `json:"user_id"`
+	Username         string      `json:"username"`
+	Terms            string      `json:"terms"`
+	Blacklist        string      `json:"blacklist"`
+	PostURL          null.String `json:"post_url"`
+	PostThumbnailURL null.String `json:"post_thumbnail_url"`
+	PostDescription  null.String `json:"post_description"`
+	CreatedAt        time.Time   `json:"created_at"`
+	UpdatedAt        time.Time   `json:"updated_at"`
+	SetBy            null.String `json:"set_by"`
+	ResponseType     null.String `json:"response_type"`
+	ResponseText     null.String `json:"response_text"`
+	URL              string      `json:"url"`
+}
+
+// Client talks to Walltaker, or anything serving the same API
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+	UserAgent  string
+	// APIKey is needed to set wallpapers and respond to them. Find yours on
+	// your Walltaker dashboard.
+	APIKey string
+}
+
+// ErrNoAPIKey is returned by actions that need an API key when there's none
+var ErrNoAPIKey = errors.New("walltaker: no API key")
+
+func NewClient(userAgent string) *Client {
+	return &Client{
+		BaseURL: DefaultBaseURL,
+		HTTPClient: &http.Client{
+			Timeout: time.Second * 2,
+		},
+		UserAgent: userAgent,
+	}
+}
+
+// GetLink fetches a link
+func (c *Client) GetLink(ctx context.Context, id int64) (Link, error) {
+	link := Link{}
+	err := c.getJSON(ctx, fmt.Sprintf("/links/%d.json", id), &link)
+	return link, err
+}
+
+// ListLinks fetches the links of a user
+func (c *Client) ListLinks(ctx context.Context, username string) ([]Link, error) {
+	links := []Link{}
+	err := c.getJSON(ctx, "/api/users/"+url.PathEscape(username)+"/links.json", &links)
+	return links, err
+}
+
+// SetPost sets the wallpaper of link id to an e621 post
+func (c *Client) SetPost(ctx context.Context, id int64, postID int) (Link, error) {
+	link := Link{}
+	if c.APIKey == "" {
+		return link, ErrNoAPIKey
+	}
+	err := c.postJSON(ctx, fmt.Sprintf("/api/links/%d.json", id), map[string]interface{}{
+		"api_key": c.APIKey,
+		"post_id": postID,
+	}, &link)
+	return link, err
+}
+
+// Response is what the owner of a link thinks of their wallpaper
+type Response struct {
+	// Type is one of the Response* types
+	Type string `json:"type"`
+	// Text is an optional comment
+	Text string `json:"text,omitempty"`
+}
+
+const (
+	ResponseHorny   = "horny"
+	ResponseDisgust = "disgust"
+	ResponseCame    = "came"
+	ResponseOK      = "ok"
+)
+
+// ResponseTypes are all the response types Walltaker knows
+var ResponseTypes = []string{ResponseHorny, ResponseDisgust, ResponseCame, ResponseOK}
+
+// Respond tells whoever set the wallpaper of link id what you think of it
+func (c *Client) Respond(ctx context.Context, id int64, response Response) (Link, error) {
+	link := Link{}
+	if c.APIKey == "" {
+		return link, ErrNoAPIKey
+	}
+	err := c.postJSON(ctx, fmt.Sprintf("/api/links/%d/response.json", id), map[string]interface{}{
+		"api_key": c.APIKey,
+		"type":    response.Type,
+		"text":    response.Text,
+	}, &link)
+	return link, err
+}
+
+func (c *Client) getJSON(ctx context.Context, path string, v interface{}) error {
+	return c.doJSON(ctx, http.MethodGet, path, nil, v)
+}
+
+func (c *Client) postJSON(ctx context.Context, path string, body interface{}, v interface{}) error {
+	return c.doJSON(ctx, http.MethodPost, path, body, v)
+}
+
+func (c *Client) doJSON(ctx context.Context, method string, path string, body interface{}, v interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		dat, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(dat)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.base()+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", c.UserAgent)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		message, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return &StatusError{StatusCode: res.StatusCode, Status: res.Status, Path: path, Message: strings.TrimSpace(string(message))}
+	}
+
+	dat, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(dat, v)
+}
+
+// StatusError is returned when Walltaker answers with anything but a 2xx
+type StatusError struct {
+	StatusCode int
+	Status     string
+	Path       string
+	// Message is the start of the body, Walltaker sometimes says what's wrong
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("walltaker returned %s for %s: %s", e.Status, e.Path, e.Message)
+	}
+	return fmt.Sprintf("walltaker returned %s for %s", e.Status, e.Path)
+}
+
+// LinkURL is the web page of a link
+func (c *Client) LinkURL(id int64) string {
+	return fmt.Sprintf("%s/links/%d", c.base(), id)
+}
+
+// UserURL is the web page of a user
+func (c *Client) UserURL(username string) string {
+	return c.base() + "/users/" + url.PathEscape(username)
+}
+
+// CableURL is the ActionCable endpoint that pushes link updates
+func (c *Client) CableURL() (*url.URL, error) {
+	u, err := url.Parse(c.base() + "/cable")
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "https":
+		u.Scheme = "wss"
+	case "http":
+		u.Scheme = "ws"
+	}
+	return u, nil
+}
+
+func (c *Client) base() string {
+	return strings.TrimRight(c.BaseURL, "/")
+}